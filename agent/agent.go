@@ -0,0 +1,227 @@
+// Package agent keeps passwords and derived keys in locked memory for a limited time and serves
+// them to goCryptor commands over a Unix domain socket, in the style of ssh-agent
+package agent
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// PasswordName is the entry the CLI and GUI use for the unlocked password
+const PasswordName = "password"
+
+// request is a single line of JSON sent by the client, one request per connection
+type request struct {
+	Op     string `json:"op"`
+	Name   string `json:"name,omitempty"`
+	Secret []byte `json:"secret,omitempty"`
+	// TTL in seconds, zero uses the agent's timeout
+	TTL int64 `json:"ttl,omitempty"`
+}
+
+type response struct {
+	OK     bool   `json:"ok"`
+	Secret []byte `json:"secret,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type entry struct {
+	secret  []byte
+	expires time.Time
+}
+
+// Agent holds secrets until their timeout expires or they are removed
+type Agent struct {
+	mu      sync.Mutex
+	entries map[string]*entry
+	timeout time.Duration
+}
+
+// New creates an agent whose secrets expire after timeout, zero keeps them until removed
+func New(timeout time.Duration) *Agent {
+	return &Agent{entries: make(map[string]*entry), timeout: timeout}
+}
+
+// DefaultSocketPath is $GOCRYPTOR_AGENT_SOCK, or the socket in $XDG_RUNTIME_DIR. Without either it
+// is empty: there is no shared folder that other users cannot write to, so an agent makes its own
+// with TempSocketPath and prints where it is.
+func DefaultSocketPath() string {
+	if path := os.Getenv("GOCRYPTOR_AGENT_SOCK"); path != "" {
+		return path
+	}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "gocryptor-agent.sock")
+	}
+	return ""
+}
+
+// TempSocketPath makes a folder in the temp dir that only the current user can open, as ssh-agent
+// does, and returns a socket path inside it
+func TempSocketPath() (string, error) {
+	dir, err := ioutil.TempDir("", "gocryptor-")
+	if err != nil {
+		return "", errors.New("unable to create agent folder: " + err.Error())
+	}
+	return filepath.Join(dir, "agent."+strconv.Itoa(os.Getpid())), nil
+}
+
+// Listen creates the agent socket. Its folder must belong to the current user and be closed to
+// everyone else, and the socket is created readable only by the user. A socket left behind by an
+// agent that died is replaced, a live one is an error.
+func Listen(socketPath string) (net.Listener, error) {
+	err := checkSocketPath(socketPath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Lstat(socketPath); err == nil {
+		if conn, err := net.Dial("unix", socketPath); err == nil {
+			conn.Close()
+			return nil, errors.New("an agent is already listening on " + socketPath)
+		}
+		os.Remove(socketPath)
+	}
+	listener, err := listenPrivate(socketPath)
+	if err != nil {
+		return nil, errors.New("unable to listen on agent socket: " + err.Error())
+	}
+	return listener, nil
+}
+
+// ListenAndServe creates the socket with Listen and serves until it fails
+func (a *Agent) ListenAndServe(socketPath string) error {
+	listener, err := Listen(socketPath)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	return a.Serve(listener)
+}
+
+// Serve answers requests on the listener and expires secrets in the background. Connections from
+// other users are closed unanswered.
+func (a *Agent) Serve(listener net.Listener) error {
+	if a.timeout > 0 {
+		go a.expireLoop()
+	}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go a.handle(conn)
+	}
+}
+
+func (a *Agent) handle(conn net.Conn) {
+	defer conn.Close()
+	if checkPeer(conn) != nil {
+		return
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return
+	}
+	req := request{}
+	resp := response{}
+	err = json.Unmarshal(line, &req)
+	if err != nil {
+		resp.Error = "malformed request"
+	} else {
+		resp = a.apply(req)
+	}
+	json.NewEncoder(conn).Encode(resp)
+	wipe(resp.Secret)
+	wipe(req.Secret)
+}
+
+// apply performs one request against the stored secrets
+func (a *Agent) apply(req request) response {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	switch req.Op {
+	case "get":
+		e, ok := a.entries[req.Name]
+		if !ok || e.expired() {
+			return response{Error: "not found"}
+		}
+		return response{OK: true, Secret: append([]byte(nil), e.secret...)}
+	case "put":
+		a.remove(req.Name)
+		e := &entry{secret: lockedCopy(req.Secret)}
+		ttl := a.timeout
+		if req.TTL > 0 {
+			ttl = time.Duration(req.TTL) * time.Second
+		}
+		if ttl > 0 {
+			e.expires = time.Now().Add(ttl)
+		}
+		a.entries[req.Name] = e
+		return response{OK: true}
+	case "delete":
+		a.remove(req.Name)
+		return response{OK: true}
+	case "clear":
+		for name := range a.entries {
+			a.remove(name)
+		}
+		return response{OK: true}
+	}
+	return response{Error: "unknown operation: " + req.Op}
+}
+
+// remove wipes and unlocks a secret, the caller holds the lock
+func (a *Agent) remove(name string) {
+	e, ok := a.entries[name]
+	if !ok {
+		return
+	}
+	unlock(e.secret)
+	delete(a.entries, name)
+}
+
+func (a *Agent) expireLoop() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		a.mu.Lock()
+		for name, e := range a.entries {
+			if e.expired() {
+				a.remove(name)
+			}
+		}
+		a.mu.Unlock()
+	}
+}
+
+func (e *entry) expired() bool {
+	return !e.expires.IsZero() && time.Now().After(e.expires)
+}
+
+// lockedCopy copies the secret into memory that is locked so it is never swapped to disk
+func lockedCopy(secret []byte) []byte {
+	locked := make([]byte, len(secret))
+	copy(locked, secret)
+	lock(locked)
+	return locked
+}
+
+// unlock wipes the secret before releasing the lock on its memory
+func unlock(secret []byte) {
+	wipe(secret)
+	munlock(secret)
+}
+
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
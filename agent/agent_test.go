@@ -0,0 +1,139 @@
+// +build linux darwin freebsd openbsd netbsd dragonfly
+
+package agent
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// startAgent serves a new agent with the timeout on a socket in a private temp folder
+func startAgent(t *testing.T, timeout time.Duration) (*Agent, *Client, net.Listener) {
+	dir, err := ioutil.TempDir("", "gocryptor-agent-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	socketPath := filepath.Join(dir, "agent.sock")
+	listener, err := Listen(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	a := New(timeout)
+	go a.Serve(listener)
+	return a, &Client{SocketPath: socketPath}, listener
+}
+
+func expectSecret(t *testing.T, c *Client, name, want string) {
+	t.Helper()
+	secret, ok := c.Get(name)
+	if !ok || string(secret) != want {
+		t.Fatalf("get %s: got %q, %v, want %q", name, secret, ok, want)
+	}
+}
+
+func expectMissing(t *testing.T, c *Client, name string) {
+	t.Helper()
+	if secret, ok := c.Get(name); ok {
+		t.Fatalf("get %s: got %q, want nothing", name, secret)
+	}
+}
+
+func TestProtocol(t *testing.T) {
+	_, c, listener := startAgent(t, 0)
+	if !c.Running() {
+		t.Fatal("agent should be running")
+	}
+	expectMissing(t, c, PasswordName)
+	c.Put(PasswordName, []byte("first"))
+	expectSecret(t, c, PasswordName, "first")
+	c.Put(PasswordName, []byte("second"))
+	expectSecret(t, c, PasswordName, "second")
+
+	err := c.Delete(PasswordName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectMissing(t, c, PasswordName)
+	// deleting what is not there is not an error
+	err = c.Delete("never stored")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Put("a", []byte("1"))
+	c.Put("b", []byte("2"))
+	err = c.Clear()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectMissing(t, c, "a")
+	expectMissing(t, c, "b")
+
+	_, err = c.call(request{Op: "bogus"})
+	if err == nil || err.Error() != "agent error: unknown operation: bogus" {
+		t.Fatalf("unknown operation: got %v", err)
+	}
+	conn, err := c.dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("not json\n"))
+	line, _ := bufio.NewReader(conn).ReadString('\n')
+	conn.Close()
+	if line != `{"ok":false,"error":"malformed request"}`+"\n" {
+		t.Fatalf("malformed request: got %q", line)
+	}
+
+	listener.Close()
+	if c.Running() {
+		t.Fatal("agent should not be running once its listener is closed")
+	}
+	if _, ok := c.Get("a"); ok {
+		t.Fatal("get should fail without an agent")
+	}
+}
+
+func TestTTL(t *testing.T) {
+	a, c, _ := startAgent(t, 0)
+	err := c.PutWithTTL("short", []byte("s"), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Put("kept", []byte("k"))
+	expectSecret(t, c, "short", "s")
+	time.Sleep(1100 * time.Millisecond)
+	expectMissing(t, c, "short")
+	// with no timeout secrets stay until removed
+	expectSecret(t, c, "kept", "k")
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.entries["short"] == nil {
+		t.Fatal("without a timeout there is no expiry loop, the entry is only hidden")
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	a, c, _ := startAgent(t, time.Second)
+	c.Put(PasswordName, []byte("pw"))
+	err := c.PutWithTTL("longer", []byte("l"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectSecret(t, c, PasswordName, "pw")
+	time.Sleep(2200 * time.Millisecond)
+	expectMissing(t, c, PasswordName)
+	// a TTL given with the secret wins over the agent's timeout
+	expectSecret(t, c, "longer", "l")
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.entries[PasswordName]; ok {
+		t.Fatal("the expiry loop should have removed the expired secret")
+	}
+}
@@ -0,0 +1,130 @@
+package agent
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/deranjer/gocryptor/encryptor"
+)
+
+// Client talks to a running agent, it implements encryptor.KeyCache
+type Client struct {
+	SocketPath string
+}
+
+// NewClient returns a client for the agent at the default socket path
+func NewClient() *Client {
+	return &Client{SocketPath: DefaultSocketPath()}
+}
+
+// Running reports whether an agent is listening on the socket
+func (c *Client) Running() bool {
+	conn, err := c.dial()
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// dial connects to the agent once the socket and its folder are known to belong to the current
+// user, and the process listening on it is known to run as that user. Another user able to put a
+// socket in its place could otherwise collect every password stored, or hand out its own.
+func (c *Client) dial() (net.Conn, error) {
+	if c.SocketPath == "" {
+		return nil, errors.New("agent is not running: no socket path")
+	}
+	err := checkSocketPath(c.SocketPath)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialTimeout("unix", c.SocketPath, time.Second)
+	if err != nil {
+		return nil, errors.New("agent is not running: " + err.Error())
+	}
+	err = checkPeer(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Get fetches a secret, returning false if the agent is not running or does not have it
+func (c *Client) Get(name string) ([]byte, bool) {
+	resp, err := c.call(request{Op: "get", Name: name})
+	if err != nil {
+		return nil, false
+	}
+	return resp.Secret, true
+}
+
+// Put stores a secret using the agent's timeout, errors are ignored since the agent is only a cache
+func (c *Client) Put(name string, secret []byte) {
+	c.call(request{Op: "put", Name: name, Secret: secret})
+}
+
+// PutWithTTL stores a secret that expires after ttl
+func (c *Client) PutWithTTL(name string, secret []byte, ttl time.Duration) error {
+	_, err := c.call(request{Op: "put", Name: name, Secret: secret, TTL: int64(ttl / time.Second)})
+	return err
+}
+
+// Delete removes a secret from the agent
+func (c *Client) Delete(name string) error {
+	_, err := c.call(request{Op: "delete", Name: name})
+	return err
+}
+
+// Clear removes every secret from the agent
+func (c *Client) Clear() error {
+	_, err := c.call(request{Op: "clear"})
+	return err
+}
+
+func (c *Client) call(req request) (*response, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	err = json.NewEncoder(conn).Encode(req)
+	if err != nil {
+		return nil, errors.New("agent write error: " + err.Error())
+	}
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return nil, errors.New("agent read error: " + err.Error())
+	}
+	resp := &response{}
+	err = json.Unmarshal(line, resp)
+	if err != nil {
+		return nil, errors.New("agent sent a malformed response")
+	}
+	if !resp.OK {
+		return nil, errors.New("agent error: " + resp.Error)
+	}
+	return resp, nil
+}
+
+// KeyProvider consults the agent for the password before falling back to another provider,
+// callers store the password with Put once it has been used successfully
+type KeyProvider struct {
+	Client   *Client
+	Fallback encryptor.KeyProvider
+}
+
+// Password returns the agent's password if it has one, otherwise asks the fallback
+func (p *KeyProvider) Password(confirm bool) (string, error) {
+	if secret, ok := p.Client.Get(PasswordName); ok {
+		return string(secret), nil
+	}
+	if p.Fallback == nil {
+		return "", errors.New("agent has no password and there is no other password source")
+	}
+	return p.Fallback.Password(confirm)
+}
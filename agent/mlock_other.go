@@ -0,0 +1,8 @@
+// +build !linux,!darwin,!freebsd,!openbsd,!netbsd,!dragonfly
+
+package agent
+
+// lock is a no-op where mlock is not available
+func lock(b []byte) {}
+
+func munlock(b []byte) {}
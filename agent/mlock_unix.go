@@ -0,0 +1,18 @@
+// +build linux darwin freebsd openbsd netbsd dragonfly
+
+package agent
+
+import "golang.org/x/sys/unix"
+
+// lock keeps the secret out of swap, failure (for example RLIMIT_MEMLOCK) is not fatal
+func lock(b []byte) {
+	if len(b) > 0 {
+		unix.Mlock(b)
+	}
+}
+
+func munlock(b []byte) {
+	if len(b) > 0 {
+		unix.Munlock(b)
+	}
+}
@@ -0,0 +1,24 @@
+package agent
+
+import "unsafe"
+
+// localPeercred is LOCAL_PEERCRED at level SOL_LOCAL (0), which x/sys does not define
+const localPeercred = 0x1
+
+// xucred is DragonFly's struct xucred
+type xucred struct {
+	version uint32
+	uid     uint32
+	ngroups int16
+	groups  [16]uint32
+}
+
+// peerUID reads the uid of the process at the other end of a Unix socket from LOCAL_PEERCRED
+func peerUID(fd int) (int, error) {
+	var cred xucred
+	err := getsockopt(fd, 0, localPeercred, unsafe.Pointer(&cred), unsafe.Sizeof(cred))
+	if err != nil {
+		return 0, err
+	}
+	return int(cred.uid), nil
+}
@@ -0,0 +1,23 @@
+package agent
+
+import "unsafe"
+
+// localPeereid is LOCAL_PEEREID at level SOL_LOCAL (0), which x/sys does not define
+const localPeereid = 0x3
+
+// unpcbid is NetBSD's struct unpcbid
+type unpcbid struct {
+	pid int32
+	uid uint32
+	gid uint32
+}
+
+// peerUID reads the uid of the process at the other end of a Unix socket from LOCAL_PEEREID
+func peerUID(fd int) (int, error) {
+	var cred unpcbid
+	err := getsockopt(fd, 0, localPeereid, unsafe.Pointer(&cred), unsafe.Sizeof(cred))
+	if err != nil {
+		return 0, err
+	}
+	return int(cred.uid), nil
+}
@@ -0,0 +1,24 @@
+package agent
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// sockpeercred is OpenBSD's struct sockpeercred
+type sockpeercred struct {
+	uid uint32
+	gid uint32
+	pid int32
+}
+
+// peerUID reads the uid of the process at the other end of a Unix socket from SO_PEERCRED
+func peerUID(fd int) (int, error) {
+	var cred sockpeercred
+	err := getsockopt(fd, unix.SOL_SOCKET, unix.SO_PEERCRED, unsafe.Pointer(&cred), unsafe.Sizeof(cred))
+	if err != nil {
+		return 0, err
+	}
+	return int(cred.uid), nil
+}
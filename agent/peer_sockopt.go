@@ -0,0 +1,20 @@
+// +build openbsd netbsd dragonfly
+
+package agent
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// getsockopt fills val, a structure of size bytes, with a socket option. x/sys has no typed wrapper
+// for the peer credential options of these systems.
+func getsockopt(fd, level, name int, val unsafe.Pointer, size uintptr) error {
+	length := uint32(size)
+	_, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, uintptr(fd), uintptr(level), uintptr(name), uintptr(val), uintptr(unsafe.Pointer(&length)), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
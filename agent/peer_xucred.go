@@ -0,0 +1,14 @@
+// +build darwin freebsd
+
+package agent
+
+import "golang.org/x/sys/unix"
+
+// peerUID reads the uid of the process at the other end of a Unix socket from LOCAL_PEERCRED
+func peerUID(fd int) (int, error) {
+	cred, err := unix.GetsockoptXucred(fd, unix.SOL_LOCAL, unix.LOCAL_PEERCRED)
+	if err != nil {
+		return 0, err
+	}
+	return int(cred.Uid), nil
+}
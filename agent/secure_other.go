@@ -0,0 +1,23 @@
+// +build !linux,!darwin,!freebsd,!openbsd,!netbsd,!dragonfly
+
+package agent
+
+import (
+	"errors"
+	"net"
+)
+
+// errUnsupported is returned where the owner of a socket and its peer cannot be checked
+var errUnsupported = errors.New("the agent is only supported on Unix systems")
+
+func checkSocketPath(path string) error {
+	return errUnsupported
+}
+
+func listenPrivate(path string) (net.Listener, error) {
+	return nil, errUnsupported
+}
+
+func checkPeer(conn net.Conn) error {
+	return errUnsupported
+}
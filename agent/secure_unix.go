@@ -0,0 +1,84 @@
+// +build linux darwin freebsd openbsd netbsd dragonfly
+
+package agent
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// checkSocketPath refuses a socket whose folder is not the current user's alone, or that is not a
+// socket belonging to the current user. A path that does not exist yet is fine.
+func checkSocketPath(path string) error {
+	uid := uint32(os.Getuid())
+	dir := filepath.Dir(path)
+	var st unix.Stat_t
+	err := unix.Stat(dir, &st)
+	if err != nil {
+		return errors.New("unable to check agent folder: " + err.Error())
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFDIR {
+		return errors.New("agent folder " + dir + " is not a folder")
+	}
+	if st.Uid != uid {
+		return errors.New("agent folder " + dir + " belongs to another user")
+	}
+	if st.Mode&0022 != 0 {
+		return errors.New("agent folder " + dir + " can be written by other users")
+	}
+	err = unix.Lstat(path, &st)
+	if err == unix.ENOENT {
+		return nil
+	}
+	if err != nil {
+		return errors.New("unable to check agent socket: " + err.Error())
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFSOCK {
+		return errors.New(path + " is not a socket")
+	}
+	if st.Uid != uid {
+		return errors.New("agent socket " + path + " belongs to another user")
+	}
+	return nil
+}
+
+// listenPrivate listens on path with a umask that makes the socket readable only by the user from
+// the moment it exists. The umask is process wide, the agent creates no other files meanwhile.
+func listenPrivate(path string) (net.Listener, error) {
+	old := unix.Umask(0177)
+	listener, err := net.Listen("unix", path)
+	unix.Umask(old)
+	return listener, err
+}
+
+// checkPeer makes sure the process at the other end of conn runs as the current user
+func checkPeer(conn net.Conn) error {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return errors.New("agent connection is not a Unix socket")
+	}
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var uid int
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		uid, credErr = peerUID(int(fd))
+	})
+	if err == nil {
+		err = credErr
+	}
+	if err != nil {
+		return errors.New("unable to identify the other end of the agent socket: " + err.Error())
+	}
+	if uid != os.Getuid() {
+		return errors.New("the other end of the agent socket runs as another user (uid " + strconv.Itoa(uid) + ")")
+	}
+	return nil
+}
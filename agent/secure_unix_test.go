@@ -0,0 +1,181 @@
+// +build linux darwin freebsd openbsd netbsd dragonfly
+
+package agent
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// The test binary doubles as a client running as another user: when GOCRYPTOR_AGENT_TEST_DIAL is
+// set it sends a put to that socket and prints whether the agent answered
+func TestMain(m *testing.M) {
+	if socketPath := os.Getenv("GOCRYPTOR_AGENT_TEST_DIAL"); socketPath != "" {
+		fmt.Print(rawPut(socketPath))
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// rawPut stores a secret without the client's own checks, returning "answered", "closed" or the error
+func rawPut(socketPath string) string {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return err.Error()
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	json.NewEncoder(conn).Encode(request{Op: "put", Name: "intruder", Secret: []byte("x")})
+	_, err = bufio.NewReader(conn).ReadString('\n')
+	if err == io.EOF {
+		return "closed"
+	}
+	if err != nil {
+		return err.Error()
+	}
+	return "answered"
+}
+
+func TestCheckSocketPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gocryptor-agent-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "agent.sock")
+	if err := checkSocketPath(socketPath); err != nil {
+		t.Fatalf("private folder: %v", err)
+	}
+	for _, mode := range []os.FileMode{0720, 0770, 0702, 0777} {
+		os.Chmod(dir, mode)
+		err := checkSocketPath(socketPath)
+		if err == nil || !strings.Contains(err.Error(), "can be written by other users") {
+			t.Fatalf("folder mode %o: got %v", mode, err)
+		}
+		if _, err := Listen(socketPath); err == nil {
+			t.Fatalf("folder mode %o: the agent listened", mode)
+		}
+		if (&Client{SocketPath: socketPath}).Running() {
+			t.Fatalf("folder mode %o: the client connected", mode)
+		}
+	}
+	os.Chmod(dir, 0700)
+
+	// something other than a socket in its place
+	err = ioutil.WriteFile(socketPath, nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkSocketPath(socketPath)
+	if err == nil || !strings.Contains(err.Error(), "is not a socket") {
+		t.Fatalf("regular file: got %v", err)
+	}
+	os.Remove(socketPath)
+
+	err = checkSocketPath(filepath.Join(dir, "missing", "agent.sock"))
+	if err == nil {
+		t.Fatal("a missing folder should be refused")
+	}
+}
+
+// otherUser is the uid and gid tests that need a second user run as, only root can switch to it
+const otherUser = 65534
+
+func TestCheckSocketPathOtherOwner(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("needs root to give the folder to another user")
+	}
+	dir, err := ioutil.TempDir("", "gocryptor-agent-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "agent.sock")
+	listener, err := Listen(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	os.Lchown(socketPath, otherUser, otherUser)
+	err = checkSocketPath(socketPath)
+	if err == nil || !strings.Contains(err.Error(), "belongs to another user") {
+		t.Fatalf("socket of another user: got %v", err)
+	}
+	os.Chown(dir, otherUser, otherUser)
+	err = checkSocketPath(socketPath)
+	if err == nil || !strings.Contains(err.Error(), "folder "+dir+" belongs to another user") {
+		t.Fatalf("folder of another user: got %v", err)
+	}
+}
+
+func TestRejectsOtherUser(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("needs root to connect as another user")
+	}
+	// the agent's own checks would keep the other user out of a private folder, so this socket is
+	// opened to everyone to show the peer check alone refuses them
+	dir, err := ioutil.TempDir("", "gocryptor-agent-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Chmod(dir, 0755)
+	socketPath := filepath.Join(dir, "agent.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	os.Chmod(socketPath, 0777)
+	a := New(0)
+	go a.Serve(listener)
+
+	// a copy of the test binary the other user can run
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary, err := ioutil.ReadFile(self)
+	if err != nil {
+		t.Fatal(err)
+	}
+	program := filepath.Join(dir, "agent.test")
+	err = ioutil.WriteFile(program, binary, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := func(uid uint32) string {
+		cmd := exec.Command(program)
+		cmd.Env = append(os.Environ(), "GOCRYPTOR_AGENT_TEST_DIAL="+socketPath)
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: uid, Gid: uid}}
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("uid %d: %v", uid, err)
+		}
+		return string(out)
+	}
+	if got := run(otherUser); got != "closed" {
+		t.Fatalf("another user: the agent %s", got)
+	}
+	a.mu.Lock()
+	_, stored := a.entries["intruder"]
+	a.mu.Unlock()
+	if stored {
+		t.Fatal("the secret of another user was stored")
+	}
+	// the same client as the agent's own user is answered
+	if got := run(0); got != "answered" {
+		t.Fatalf("same user: the agent %s", got)
+	}
+}
@@ -0,0 +1,519 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/deranjer/gocryptor/encryptor"
+)
+
+// processFile encrypts, decrypts or verifies one file according to the options, sealing or opening up
+// to concurrency chunks at once, progress may be nil. Once ctx is done the file is abandoned and
+// nothing it had written is left behind.
+func processFile(ctx context.Context, opts *options, wrapper encryptor.KeyWrapper, path string, isDir bool, concurrency int, progress func(encryptor.Progress)) fileResult {
+	start := time.Now()
+	res := fileResult{Path: path, Action: opts.command, Bytes: fileSize(path)}
+	fileOpts := &encryptor.Options{
+		Wrapper:     wrapper,
+		Conflict:    opts.conflict,
+		Ask:         opts.ask,
+		NoAttrs:     opts.noAttrs,
+		Xattrs:      opts.xattrs,
+		Ownership:   opts.owner,
+		Dispose:     opts.dispose,
+		Concurrency: concurrency,
+		Progress:    progress,
+	}
+	var err error
+	switch opts.command {
+	case "encrypt":
+		err = checkNotEncrypted(path)
+		if err != nil {
+			break
+		}
+		res.Output, err = outputPath(opts, path, isDir)
+		if err == nil {
+			err = os.MkdirAll(filepath.Dir(res.Output), 0755)
+		}
+		if err == nil {
+			res.Output, err = encryptor.EncryptFileContext(ctx, path, res.Output, fileOpts)
+		}
+	case "decrypt":
+		var result *encryptor.Result
+		if opts.output != "" {
+			result, err = encryptor.DecryptFileContext(ctx, path, opts.output, fileOpts)
+		} else {
+			var dir string
+			dir, err = outputDirFor(opts, path, isDir)
+			if err == nil {
+				err = os.MkdirAll(dir, 0755)
+			}
+			if err == nil {
+				result, err = encryptor.DecryptFileToDirContext(ctx, path, dir, fileOpts)
+			}
+		}
+		if result != nil {
+			res.Output = result.Output
+		}
+	case "verify":
+		_, err = encryptor.VerifyContext(ctx, path, fileOpts)
+	}
+	res.DurationMS = time.Since(start).Milliseconds()
+	if err == encryptor.ErrSkipped {
+		res.Output, res.Skipped = "", "output exists"
+		return res
+	}
+	if disposeErr, ok := err.(*encryptor.DisposeError); ok {
+		// the output is written, only the input is left over
+		res.Warning, res.Code = disposeErr.Error(), exitDisposeFailed
+		return res
+	}
+	if err != nil {
+		res.Output, res.Error, res.Code = "", err.Error(), exitCodeFor(err)
+	} else if opts.command != "verify" && opts.dispose != encryptor.DispositionKeep {
+		res.Disposed = opts.dispose.String()
+	}
+	return res
+}
+
+// streamMemory bounds the buffered readers and writers around one file in the container format,
+// the chunks in flight are counted on top
+const streamMemory = 1 << 20
+
+// encryptChunkSize is the chunk size new files are written with
+const encryptChunkSize = 64 << 10
+
+// defaultMemoryBudget is how much file buffering a batch allows at once unless told otherwise
+const defaultMemoryBudget = 512 << 20
+
+// batchJob is a file of a batch, index keeps the results in the order the walk found the files
+type batchJob struct {
+	index int
+	path  string
+	res   fileResult
+}
+
+// batchProgress is what a batch has got through so far
+type batchProgress struct {
+	Files     int
+	FilesDone int
+	// Bytes is the size of all the input files, BytesDone how much of it has been read
+	Bytes     int64
+	BytesDone int64
+	// File is the file most recently read from
+	File string
+}
+
+// progressTracker adds up the progress of the files being processed at once
+type progressTracker struct {
+	mu       sync.Mutex
+	report   func(batchProgress)
+	progress batchProgress
+	// read is how far each file in progress has got
+	read map[string]int64
+}
+
+// fileRead records that path has been read up to done
+func (t *progressTracker) fileRead(p encryptor.Progress) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.progress.BytesDone += p.Done - t.read[p.File]
+	t.read[p.File] = p.Done
+	t.progress.File = p.File
+	t.report(t.progress)
+}
+
+// fileDone counts path as finished, a file that failed or was skipped counts as fully read
+func (t *progressTracker) fileDone(path string, size int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.progress.BytesDone += size - t.read[path]
+	delete(t.read, path)
+	t.progress.FilesDone++
+	t.report(t.progress)
+}
+
+// runBatch processes the file, every file the filters let through in the folder, or opts.paths if
+// set, on a pool of opts.jobs workers, GOMAXPROCS by default. Files only start while their buffers
+// fit in the memory budget. emit is called on the calling goroutine with each result in walk order,
+// the files the walk left out included as skipped, and opts.progress, if set, from the workers one
+// call at a time. Once ctx is done no more files are started, the ones
+// in progress stop and remove their partial output, and ctx's error is returned.
+func runBatch(ctx context.Context, opts *options, wrapper encryptor.KeyWrapper, isDir bool, emit func(fileResult)) error {
+	// the files are listed first so progress can be given against the total
+	var paths []string
+	var sizes []int64
+	// skips holds the files the walk left out, each under the index of the file found after them
+	skips := make(map[int][]fileResult)
+	tracker := &progressTracker{report: opts.progress, read: make(map[string]int64)}
+	add := func(path string) {
+		paths = append(paths, path)
+		sizes = append(sizes, fileSize(path))
+		tracker.progress.Bytes += sizes[len(sizes)-1]
+	}
+	var err error
+	if opts.paths != nil {
+		for _, path := range opts.paths {
+			add(path)
+		}
+	} else {
+		err = forEachFile(opts.fileName, isDir, opts.command != "encrypt", newFileFilter(opts.includes, opts.excludes), add, func(path, reason string) {
+			skips[len(paths)] = append(skips[len(paths)], fileResult{Path: path, Action: opts.command, Skipped: reason})
+		})
+	}
+	tracker.progress.Files = len(paths)
+	if opts.queued != nil {
+		opts.queued(paths)
+	}
+	// files of the batch must not replace each other's output, or each other
+	clashes := outputClashes(opts, paths, isDir)
+	var fileProgress func(encryptor.Progress)
+	if opts.progress != nil {
+		fileProgress = tracker.fileRead
+	}
+	workers := opts.jobs
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	concurrency := chunkConcurrency(workers, len(paths))
+	budget := newMemoryBudget(opts.memoryBudget)
+	jobs := make(chan batchJob)
+	results := make(chan batchJob)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				if clash, ok := clashes[job.index]; ok && opts.conflict != encryptor.ConflictNumber {
+					job.res = clashResult(opts, job.path, clash)
+				} else {
+					cost := budget.acquire(jobMemory(opts, job.path, concurrency))
+					job.res = processBatchFile(ctx, opts, wrapper, job.path, isDir, concurrency, fileProgress)
+					budget.release(cost)
+				}
+				if opts.progress != nil {
+					tracker.fileDone(job.path, sizes[job.index])
+				}
+				results <- job
+			}
+		}()
+	}
+	go func() {
+		defer close(results)
+		defer wg.Wait()
+		defer close(jobs)
+		for index, path := range paths {
+			if ctx.Err() != nil {
+				return
+			}
+			select {
+			case jobs <- batchJob{index: index, path: path}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	// results arrive as workers finish, hold on to them until every earlier file has been reported
+	emitSkips := func(index int) {
+		for _, res := range skips[index] {
+			emit(res)
+		}
+	}
+	pending := make(map[int]fileResult)
+	next := 0
+	for job := range results {
+		pending[job.index] = job.res
+		for res, ok := pending[next]; ok; res, ok = pending[next] {
+			delete(pending, next)
+			emitSkips(next)
+			emit(res)
+			next++
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	emitSkips(len(paths))
+	return err
+}
+
+// processBatchFile is what the workers of runBatch call for each file, tests replace it to watch how
+// many files are in flight
+var processBatchFile = processFile
+
+// chunkConcurrency shares the CPUs between the files processed at once, a lone file gets all of them
+func chunkConcurrency(workers, files int) int {
+	if files < workers {
+		workers = files
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	concurrency := runtime.GOMAXPROCS(0) / workers
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return concurrency
+}
+
+// outputClashes finds the files whose output would be the output of an earlier file of the batch,
+// as with foo.gcx and foo.txt.gcx both holding a .txt file, or another input of the batch, and says
+// why for each. Under ConflictNumber the claim on the name sorts them out, each gets its own. A file
+// named for its own output is numbered by the encryptor.
+func outputClashes(opts *options, paths []string, isDir bool) map[int]string {
+	clashes := make(map[int]string)
+	if opts.command == "verify" {
+		return clashes
+	}
+	inputs := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		inputs[path] = true
+	}
+	first := make(map[string]string)
+	for i, path := range paths {
+		output, err := plannedOutput(opts, path, isDir)
+		if err != nil || output == "" || encryptor.SameFile(output, path) {
+			continue
+		}
+		if earlier, ok := first[output]; ok {
+			clashes[i] = "same output as " + earlier
+			continue
+		}
+		if inputs[output] {
+			clashes[i] = "output is " + output + ", another file of this run"
+			continue
+		}
+		first[output] = path
+	}
+	return clashes
+}
+
+// clashResult is the result of a file held back by outputClashes: skipped under ConflictSkip and
+// failed otherwise, even under ConflictOverwrite, so nothing of the batch is replaced
+func clashResult(opts *options, path, clash string) fileResult {
+	res := fileResult{Path: path, Action: opts.command, Bytes: fileSize(path)}
+	if opts.conflict == encryptor.ConflictSkip {
+		res.Skipped = clash
+		return res
+	}
+	res.Error, res.Code = clash+", nothing was replaced", exitFailure
+	return res
+}
+
+// jobMemory estimates the bytes processing path with concurrency chunks at once holds. The container
+// format is streamed a chunk at a time, files from before it are decrypted whole.
+func jobMemory(opts *options, path string, concurrency int) int64 {
+	chunk := int64(encryptChunkSize)
+	if opts.command != "encrypt" {
+		info, err := encryptor.Inspect(path)
+		if err == nil && info.Version == 0 {
+			// the file is read whole and the plaintext is held beside it
+			return 2 * fileSize(path)
+		}
+		if err == nil {
+			chunk = int64(info.ChunkSize)
+		}
+	}
+	// each chunk has an input and an output buffer, the pipeline holds two chunks per worker and
+	// a single worker only the one it is on
+	if concurrency <= 1 {
+		return streamMemory + 2*chunk
+	}
+	return streamMemory + 4*int64(concurrency)*chunk
+}
+
+// memoryBudget is a semaphore weighted by bytes
+type memoryBudget struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	free  int64
+	limit int64
+}
+
+func newMemoryBudget(limit int64) *memoryBudget {
+	if limit <= 0 {
+		limit = defaultMemoryBudget
+	}
+	b := &memoryBudget{free: limit, limit: limit}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// acquire waits until n bytes are free and takes them, a file bigger than the whole budget waits
+// for all of it so it runs alone. It returns what was taken for release.
+func (b *memoryBudget) acquire(n int64) int64 {
+	if n > b.limit {
+		n = b.limit
+	}
+	b.mu.Lock()
+	for b.free < n {
+		b.cond.Wait()
+	}
+	b.free -= n
+	b.mu.Unlock()
+	return n
+}
+
+func (b *memoryBudget) release(n int64) {
+	b.mu.Lock()
+	b.free += n
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+// planFile works out what processFile would do with a file without deriving keys or writing anything.
+// claimed holds the outputs earlier files of the batch would take, the file's own is added to it.
+func planFile(opts *options, path string, isDir bool, claimed map[string]bool) fileResult {
+	res := fileResult{Path: path, Action: opts.command, Bytes: fileSize(path), DryRun: true}
+	var err error
+	if opts.command == "encrypt" {
+		err = checkNotEncrypted(path)
+	}
+	if err == nil {
+		res.Output, err = plannedOutput(opts, path, isDir)
+	}
+	if err == nil && res.Output != "" {
+		res.Output, err = planConflict(opts, res.Output, &res, claimed)
+	}
+	if err == encryptor.ErrSkipped {
+		res.Output, res.Skipped = "", "output exists"
+		return res
+	}
+	if err != nil {
+		res.Output, res.Error, res.Code = "", err.Error(), exitCodeFor(err)
+	} else if opts.command != "verify" && opts.dispose != encryptor.DispositionKeep {
+		res.Disposed = opts.dispose.String()
+	}
+	return res
+}
+
+// plannedOutput is where processFile writes the output of path before any conflict is resolved,
+// verify writes nothing
+func plannedOutput(opts *options, path string, isDir bool) (string, error) {
+	switch opts.command {
+	case "encrypt":
+		return outputPath(opts, path, isDir)
+	case "decrypt":
+		if opts.output != "" {
+			return opts.output, nil
+		}
+		// the original extension is in the header, which is readable without the password
+		info, err := encryptor.Inspect(path)
+		if err != nil {
+			return "", err
+		}
+		dir, err := outputDirFor(opts, path, isDir)
+		if err != nil {
+			return "", err
+		}
+		return encryptor.DecryptedName(dir, path, info.Ext), nil
+	}
+	return "", nil
+}
+
+// planConflict resolves the output the way the encryptor's claim on it would, a name is taken if it
+// exists or an earlier file of the batch claimed it. A GUI prompt is shown as a file that would be
+// replaced since the answer is not known yet.
+func planConflict(opts *options, output string, res *fileResult, claimed map[string]bool) (string, error) {
+	policy := opts.conflict
+	if policy == encryptor.ConflictAsk {
+		policy = encryptor.ConflictOverwrite
+	}
+	if encryptor.SameFile(output, res.Path) {
+		// as in the encryptor, a file is never replaced by its own output
+		policy = encryptor.ConflictNumber
+	}
+	free := func(candidate string) (bool, error) {
+		if claimed[candidate] {
+			return false, nil
+		}
+		_, err := os.Lstat(candidate)
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+		return false, err
+	}
+	ok, err := free(output)
+	if err != nil {
+		return "", err
+	}
+	resolved := output
+	if !ok {
+		switch policy {
+		case encryptor.ConflictOverwrite:
+			res.Conflict = true
+		case encryptor.ConflictSkip:
+			return "", encryptor.ErrSkipped
+		case encryptor.ConflictFail:
+			return "", encryptor.ErrExists
+		case encryptor.ConflictNumber:
+			resolved, err = encryptor.NumberedName(output, free)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+	claimed[resolved] = true
+	return resolved, nil
+}
+
+// planBatch is the dry run of runBatch: it walks the same files, holds back the same clashing
+// outputs and claims names in the same order, calling emit with what would happen to each file and
+// each file the walk skips, in walk order. Once ctx is done the remaining files are not looked at.
+func planBatch(ctx context.Context, opts *options, isDir bool, emit func(fileResult)) error {
+	// skipped files are listed where the walk found them, between the files it lets through
+	type walked struct {
+		path, skipped string
+	}
+	var entries []walked
+	var paths []string
+	err := forEachFile(opts.fileName, isDir, opts.command != "encrypt", newFileFilter(opts.includes, opts.excludes), func(path string) {
+		entries = append(entries, walked{path: path})
+		paths = append(paths, path)
+	}, func(path, reason string) {
+		entries = append(entries, walked{path: path, skipped: reason})
+	})
+	clashes := outputClashes(opts, paths, isDir)
+	claimed := make(map[string]bool)
+	index := 0
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if entry.skipped != "" {
+			emit(fileResult{Path: entry.path, Action: opts.command, Skipped: entry.skipped, DryRun: true})
+			continue
+		}
+		var res fileResult
+		if clash, ok := clashes[index]; ok && opts.conflict != encryptor.ConflictNumber {
+			res = clashResult(opts, entry.path, clash)
+			res.DryRun = true
+		} else {
+			res = planFile(opts, entry.path, isDir, claimed)
+		}
+		index++
+		emit(res)
+	}
+	return err
+}
+
+// runDryRun reports what the command would do to every file without doing it, once ctx is cancelled
+// the remaining files are no longer looked at
+func runDryRun(ctx context.Context, opts *options, isDir bool, report *reporter) int {
+	code := exitOK
+	err := planBatch(ctx, opts, isDir, func(res fileResult) {
+		code = worseExitCode(code, res.Code)
+		report.file(res)
+	})
+	if err != nil && err != ctx.Err() {
+		report.walkError(err)
+		code = worseExitCode(code, exitFailure)
+	}
+	report.finish(code)
+	return code
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/deranjer/gocryptor/encryptor"
+)
+
+// sameOutputFolder holds foo.gcx and foo.txt.gcx, which both decrypt to foo.txt, and foo.txt itself
+// when withPlain is set
+func sameOutputFolder(t *testing.T, withPlain bool) string {
+	dir, err := ioutil.TempDir("", "gocryptor-batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	plain := filepath.Join(dir, "foo.txt")
+	err = ioutil.WriteFile(plain, []byte("hello"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kdf := encryptor.KDFParams{N: 1024, R: 8, P: 1}
+	for _, name := range []string{"foo.gcx", "foo.txt.gcx"} {
+		_, err = encryptor.EncryptFileContext(context.Background(), plain, filepath.Join(dir, name), &encryptor.Options{Password: "pw", KDF: kdf})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !withPlain {
+		os.Remove(plain)
+	}
+	return dir
+}
+
+func listDir(t *testing.T, dir string) []string {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestDryRunMatchesRun(t *testing.T) {
+	policies := []encryptor.ConflictPolicy{encryptor.ConflictOverwrite, encryptor.ConflictSkip, encryptor.ConflictFail, encryptor.ConflictNumber}
+	for _, withPlain := range []bool{false, true} {
+		for _, policy := range policies {
+			dir := sameOutputFolder(t, withPlain)
+			// one worker so numbered names are claimed in walk order, as the plan claims them
+			opts := &options{command: "decrypt", fileName: dir, conflict: policy, jobs: 1}
+			before := listDir(t, dir)
+			var plan, run []fileResult
+			err := planBatch(context.Background(), opts, true, func(res fileResult) {
+				plan = append(plan, res)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			after := listDir(t, dir)
+			if len(after) != len(before) {
+				t.Fatalf("%v: the dry run changed the folder from %v to %v", policy, before, after)
+			}
+			err = runBatch(context.Background(), opts, encryptor.NewPasswordWrapper("pw", nil), true, func(res fileResult) {
+				run = append(run, res)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			name := policy.String()
+			if withPlain {
+				name += ", foo.txt exists"
+			}
+			if len(plan) != len(run) {
+				t.Fatalf("%s: planned %d files, ran %d", name, len(plan), len(run))
+			}
+			for i := range plan {
+				p, r := plan[i], run[i]
+				if p.Path != r.Path || p.Output != r.Output || p.Skipped != r.Skipped || p.Error != r.Error || p.Code != r.Code {
+					t.Errorf("%s: planned %+v, ran %+v", name, p, r)
+				}
+			}
+		}
+	}
+}
+
+func TestDryRunNumbersPastClaimedNames(t *testing.T) {
+	dir := sameOutputFolder(t, true)
+	opts := &options{command: "decrypt", fileName: dir, conflict: encryptor.ConflictNumber}
+	var outputs []string
+	err := planBatch(context.Background(), opts, true, func(res fileResult) {
+		if res.Output != "" {
+			outputs = append(outputs, filepath.Base(res.Output))
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outputs) != 2 || outputs[0] != "foo (1).txt" || outputs[1] != "foo (2).txt" {
+		t.Fatalf("got %v, want [foo (1).txt foo (2).txt]", outputs)
+	}
+}
+
+func TestChunkConcurrency(t *testing.T) {
+	cpus := runtime.GOMAXPROCS(0)
+	cases := []struct {
+		workers, files, want int
+	}{
+		{1, 10, cpus},
+		{4, 1, cpus},
+		{cpus, 100, 1},
+		{4 * cpus, 100, 1},
+		{2, 0, cpus},
+	}
+	if cpus >= 4 {
+		cases = append(cases, struct{ workers, files, want int }{2, 10, cpus / 2})
+	}
+	for _, c := range cases {
+		if got := chunkConcurrency(c.workers, c.files); got != c.want {
+			t.Errorf("%d workers, %d files: got %d, want %d", c.workers, c.files, got, c.want)
+		}
+	}
+}
+
+func TestMemoryBudgetBoundsFilesInFlight(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gocryptor-batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for i := 0; i < 8; i++ {
+		err = ioutil.WriteFile(filepath.Join(dir, string(rune('a'+i))+".txt"), []byte("hello"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	opts := &options{command: "encrypt", fileName: dir, jobs: 4}
+	// room for two files at a time
+	opts.memoryBudget = 2 * jobMemory(opts, filepath.Join(dir, "a.txt"), chunkConcurrency(4, 8))
+
+	var mu sync.Mutex
+	inFlight, most := 0, 0
+	processBatchFile = func(ctx context.Context, opts *options, wrapper encryptor.KeyWrapper, path string, isDir bool, concurrency int, progress func(encryptor.Progress)) fileResult {
+		mu.Lock()
+		inFlight++
+		if inFlight > most {
+			most = inFlight
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		return fileResult{Path: path}
+	}
+	defer func() { processBatchFile = processFile }()
+
+	files := 0
+	err = runBatch(context.Background(), opts, nil, true, func(res fileResult) { files++ })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files != 8 {
+		t.Fatalf("got %d results, want 8", files)
+	}
+	if most != 2 {
+		t.Fatalf("%d files were in flight at once, the budget allows 2", most)
+	}
+}
+
+func TestDisposeFailureIsAWarning(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gocryptor-batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	plain := filepath.Join(dir, "foo.txt")
+	err = ioutil.WriteFile(plain, []byte("hello"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a data folder that is a file leaves nowhere to put the trash
+	blocked := filepath.Join(dir, "not a folder")
+	err = ioutil.WriteFile(blocked, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataHome, hadDataHome := os.LookupEnv("XDG_DATA_HOME")
+	os.Setenv("XDG_DATA_HOME", blocked)
+	t.Cleanup(func() {
+		if hadDataHome {
+			os.Setenv("XDG_DATA_HOME", dataHome)
+		} else {
+			os.Unsetenv("XDG_DATA_HOME")
+		}
+	})
+
+	opts := &options{command: "encrypt", fileName: plain, dispose: encryptor.DispositionTrash}
+	var results []fileResult
+	err = runBatch(context.Background(), opts, encryptor.NewPasswordWrapper("pw", nil), false, func(res fileResult) {
+		results = append(results, res)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("got %d results, want 1", len(results))
+	}
+	res := results[0]
+	if res.Error != "" || res.Warning == "" || res.Code != exitDisposeFailed || res.Disposed != "" {
+		t.Fatalf("got %+v, want a success with a warning", res)
+	}
+	if res.Output != plain+".gcx" {
+		t.Fatalf("output %q, want %s", res.Output, plain+".gcx")
+	}
+	for _, path := range []string{plain, res.Output} {
+		if _, err := os.Stat(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	report := newReporter(true, ioutil.Discard, "encrypt")
+	report.file(res)
+	if report.summary.Succeeded != 1 || report.summary.Failed != 0 || report.summary.Warnings != 1 {
+		t.Fatalf("summary %+v, want one success with a warning", report.summary)
+	}
+
+	// decrypting reports the plaintext it wrote in the same way
+	os.Remove(plain)
+	opts = &options{command: "decrypt", fileName: res.Output, dispose: encryptor.DispositionTrash}
+	results = nil
+	err = runBatch(context.Background(), opts, encryptor.NewPasswordWrapper("pw", nil), false, func(res fileResult) {
+		results = append(results, res)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Warning == "" || results[0].Output != plain {
+		t.Fatalf("got %+v, want %s written with a warning", results, plain)
+	}
+}
+
+func TestRunReportsSkippedFiles(t *testing.T) {
+	dir := sameOutputFolder(t, true)
+	err := ioutil.WriteFile(filepath.Join(dir, "notes.log"), []byte("log"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &options{command: "encrypt", fileName: dir, excludes: []string{"*.log"}, conflict: encryptor.ConflictNumber}
+	var out bytes.Buffer
+	report := newReporter(true, &out, "encrypt")
+	err = runBatch(context.Background(), opts, encryptor.NewPasswordWrapper("pw", nil), true, report.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report.finish(exitOK)
+	want := []struct{ name, status, skipped string }{
+		{"foo.gcx", "skipped", "already encrypted"},
+		{"foo.txt", "", ""},
+		{"foo.txt.gcx", "skipped", "already encrypted"},
+		{"notes.log", "skipped", "excluded"},
+	}
+	decoder := json.NewDecoder(&out)
+	for _, w := range want {
+		var res fileResult
+		err = decoder.Decode(&res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if filepath.Base(res.Path) != w.name || res.Status != w.status || res.Skipped != w.skipped || res.Error != "" {
+			t.Fatalf("got %+v, want %s %q %q", res, w.name, w.status, w.skipped)
+		}
+	}
+	var sum summary
+	err = decoder.Decode(&sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sum.Summary || sum.Files != 1 || sum.Succeeded != 1 || sum.Skipped != 3 {
+		t.Fatalf("summary %+v, want one file done and three skipped", sum)
+	}
+}
@@ -0,0 +1,764 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/deranjer/gocryptor/agent"
+	"github.com/deranjer/gocryptor/encryptor"
+	"github.com/integrii/flaggy"
+)
+
+// Exit codes returned by the headless subcommands
+const (
+	exitOK = 0
+	// exitFailure means one or more files could not be processed
+	exitFailure = 1
+	// exitUsage means the arguments were wrong, for example the path does not exist
+	exitUsage = 2
+	// exitNoPassword means no password could be read, or the confirmation did not match
+	exitNoPassword = 3
+	// exitWrongKey means the password or key did not unlock a file
+	exitWrongKey = 4
+	// exitCorrupt means a file failed authentication, it is damaged or was tampered with
+	exitCorrupt = 5
+	// exitDisposeFailed means every file was processed but the input of one or more could not be
+	// trashed, deleted or shredded afterwards
+	exitDisposeFailed = 6
+	// exitCancelled means the run was interrupted, the files in progress were abandoned
+	exitCancelled = 130
+)
+
+// stdioMarker stands in for "-" (stdin or stdout) while flaggy parses the arguments
+const stdioMarker = "\x00stdio"
+
+// options holds everything parsed from the command line
+type options struct {
+	// command is the headless subcommand to run, empty to open the GUI
+	command string
+	// action pre-selects encrypt or decrypt in the GUI
+	action      string
+	fileName    string
+	keyProvider encryptor.KeyProvider
+	// conflict decides what happens when an output file exists, ask is only used by the GUI
+	conflict encryptor.ConflictPolicy
+	ask      func(path string) encryptor.ConflictPolicy
+	// output is an explicit output file for a single input, "-" for stdout
+	output string
+	// outputDir receives the results instead of writing beside the inputs, folders keep their layout
+	outputDir string
+	// includes and excludes filter the files visited in a folder
+	includes []string
+	excludes []string
+	// noAttrs stops mode and times being kept, xattrs and owner keep extended attributes and ownership too
+	noAttrs bool
+	xattrs  bool
+	owner   bool
+	// dispose is what happens to each input once its output is written and verified
+	dispose encryptor.Disposition
+	// jobs is how many files are processed at once, GOMAXPROCS when 0, and memoryBudget caps the
+	// bytes of file buffers they hold together
+	jobs         int
+	memoryBudget int64
+	// progress is told how far a batch has got, it is called from the workers one call at a time
+	progress func(batchProgress)
+	// paths, when set, are processed in place of walking fileName, which still decides where output
+	// goes, and queued is told every file of a batch before the first is started
+	paths  []string
+	queued func(paths []string)
+	// dryRun lists what would happen without deriving keys or writing anything
+	dryRun bool
+	// jsonOutput prints one JSON object per file and a summary instead of text
+	jsonOutput bool
+	// rememberPassword hands the password itself to the agent once it has worked, by default the
+	// agent only gets the keys derived from it
+	rememberPassword bool
+	// agent settings for the agent subcommand, agentOp is clear or delete when one of those is run
+	// against a running agent, and agentSecret the entry delete removes
+	socketPath      string
+	agentTimeout    time.Duration
+	agentForeground bool
+	agentOp         string
+	agentSecret     string
+}
+
+func parseFlags(logger *log.Logger) *options {
+	opts := &options{socketPath: agent.DefaultSocketPath(), agentTimeout: 15 * time.Minute}
+	flaggy.SetName("goCryptor")
+	flaggy.SetDescription("Encrypts and decrypts files and folders")
+	flaggy.DefaultParser.ShowHelpOnUnexpected = true
+	// set the default of encrypt
+	var encryptFlag string
+	// setup the encrypt flag
+	flaggy.String(&encryptFlag, "e", "encrypt", "encrypt a file or folder")
+	// decrypt var
+	var decryptFlag string
+	flaggy.String(&decryptFlag, "d", "decrypt", "selects file to decrypt")
+	// password sources so automation does not need to type into the window or use argv
+	var passwordEnv, passwordFile, passwordCommand, pinentryProgram, askpassProgram string
+	passwordFD := -1
+	flaggy.String(&passwordEnv, "", "password-env", "read the password from this environment variable")
+	flaggy.String(&passwordFile, "", "password-file", "read the password from the first line of this file")
+	flaggy.Int(&passwordFD, "", "password-fd", "read the password from this file descriptor")
+	flaggy.String(&passwordCommand, "", "password-command", "read the password from the output of this command")
+	flaggy.String(&pinentryProgram, "", "pinentry", "ask for the password with this pinentry program")
+	flaggy.String(&askpassProgram, "", "askpass", "ask for the password with this SSH_ASKPASS style helper")
+	flaggy.StringSlice(&opts.includes, "", "include", "only process files in a folder matching this gitignore style pattern, may be repeated")
+	flaggy.StringSlice(&opts.excludes, "", "exclude", "skip files and folders matching this gitignore style pattern, may be repeated")
+	flaggy.Bool(&opts.noAttrs, "", "no-attrs", "do not keep or restore file mode and times")
+	flaggy.Bool(&opts.xattrs, "", "xattrs", "keep and restore extended attributes as well")
+	flaggy.Bool(&opts.owner, "", "owner", "keep and restore the file owner as well, restoring needs the privilege to chown")
+	flaggy.Int(&opts.jobs, "j", "jobs", "how many files of a folder to process at once, the number of CPUs by default")
+	var memoryMB int
+	flaggy.Int(&memoryMB, "", "memory", "MiB of file buffers a folder may use at once, 512 by default")
+	var showProgress bool
+	flaggy.Bool(&showProgress, "", "progress", "print how far a folder has got to stderr every second")
+	flaggy.Bool(&opts.dryRun, "n", "dry-run", "list what would be done to each file without doing it")
+	flaggy.Bool(&opts.jsonOutput, "", "json", "print a JSON object for each file and a summary rather than text")
+	flaggy.Bool(&opts.rememberPassword, "", "remember-password", "keep the password itself in the running agent once it has worked, not only the keys derived from it")
+	// headless subcommands, these run without opening a window
+	encryptCmd := flaggy.NewSubcommand("encrypt")
+	encryptCmd.Description = "encrypt a file, or every file in a folder, without the GUI"
+	encryptCmd.AddPositionalValue(&opts.fileName, "path", 1, true, "file or folder to encrypt, - for stdin to stdout")
+	encryptCmd.String(&opts.output, "o", "output", "write the encrypted file here, - for stdout")
+	encryptCmd.String(&opts.outputDir, "", "output-dir", "write encrypted files into this folder, mirroring the source folder")
+	var conflictPolicy string
+	encryptCmd.String(&conflictPolicy, "c", "conflict", "when an output file exists: overwrite, skip, number or fail")
+	var disposition string
+	encryptCmd.String(&disposition, "", "dispose", "once the encrypted file verifies: keep, trash, delete or shred the original")
+	flaggy.AttachSubcommand(encryptCmd, 1)
+	var noOverwrite bool
+	decryptCmd := flaggy.NewSubcommand("decrypt")
+	decryptCmd.Description = "decrypt a .gcx file, or every .gcx file in a folder, without the GUI"
+	decryptCmd.AddPositionalValue(&opts.fileName, "path", 1, true, "file or folder to decrypt, - for stdin to stdout")
+	decryptCmd.String(&opts.output, "o", "output", "write the decrypted file here, - for stdout")
+	decryptCmd.String(&opts.outputDir, "", "output-dir", "write decrypted files into this folder, mirroring the source folder")
+	decryptCmd.String(&conflictPolicy, "c", "conflict", "when an output file exists: overwrite, skip, number or fail")
+	decryptCmd.String(&disposition, "", "dispose", "once decrypted: keep, trash, delete or shred the .gcx file")
+	decryptCmd.Bool(&noOverwrite, "", "no-overwrite", "same as --conflict number")
+	flaggy.AttachSubcommand(decryptCmd, 1)
+	verifyCmd := flaggy.NewSubcommand("verify")
+	verifyCmd.Description = "check that files decrypt with the password without writing anything"
+	verifyCmd.AddPositionalValue(&opts.fileName, "path", 1, true, "file or folder to verify, - for stdin")
+	flaggy.AttachSubcommand(verifyCmd, 1)
+	infoCmd := flaggy.NewSubcommand("info")
+	infoCmd.Description = "show the header of an encrypted file, no password needed"
+	infoCmd.AddPositionalValue(&opts.fileName, "path", 1, true, "encrypted file to inspect")
+	flaggy.AttachSubcommand(infoCmd, 1)
+	// the agent subcommand runs the key agent instead of the GUI
+	agentCmd := flaggy.NewSubcommand("agent")
+	agentCmd.Description = "holds unlocked passwords and keys for other goCryptor commands"
+	agentCmd.String(&opts.socketPath, "s", "socket", "path of the agent socket")
+	agentCmd.Duration(&opts.agentTimeout, "t", "timeout", "forget secrets after this long, 0 keeps them until the agent exits")
+	agentCmd.Bool(&opts.agentForeground, "D", "foreground", "stay in the foreground instead of running in the background")
+	agentClearCmd := flaggy.NewSubcommand("clear")
+	agentClearCmd.Description = "make the running agent forget every password and key it holds"
+	agentCmd.AttachSubcommand(agentClearCmd, 1)
+	agentDeleteCmd := flaggy.NewSubcommand("delete")
+	agentDeleteCmd.Description = "make the running agent forget one secret, the remembered password by default"
+	agentDeleteCmd.AddPositionalValue(&opts.agentSecret, "name", 1, false, "name of the secret to forget")
+	agentCmd.AttachSubcommand(agentDeleteCmd, 1)
+	flaggy.AttachSubcommand(agentCmd, 1)
+	// parse the results, flaggy treats a lone "-" as a flag so it is swapped for a marker until parsing is done
+	args := make([]string, 0, len(os.Args)-1)
+	for _, arg := range os.Args[1:] {
+		if arg == "-" {
+			arg = stdioMarker
+		}
+		args = append(args, arg)
+	}
+	flaggy.ParseArgs(args)
+	if opts.fileName == stdioMarker {
+		opts.fileName = "-"
+	}
+	if opts.output == stdioMarker {
+		opts.output = "-"
+	}
+	for _, cmd := range []*flaggy.Subcommand{encryptCmd, decryptCmd, verifyCmd, infoCmd, agentCmd} {
+		if cmd.Used {
+			opts.command = cmd.Name
+		}
+	}
+	for _, cmd := range []*flaggy.Subcommand{agentClearCmd, agentDeleteCmd} {
+		if cmd.Used {
+			opts.agentOp = cmd.Name
+		}
+	}
+	if noOverwrite {
+		opts.conflict = encryptor.ConflictNumber
+	}
+	if conflictPolicy != "" {
+		policy, err := encryptor.ParseConflictPolicy(conflictPolicy)
+		if err == nil && policy == encryptor.ConflictAsk {
+			err = errors.New("--conflict ask is only available in the GUI")
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(exitUsage)
+		}
+		opts.conflict = policy
+	}
+	if disposition != "" {
+		var err error
+		opts.dispose, err = encryptor.ParseDisposition(disposition)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(exitUsage)
+		}
+	}
+	if opts.jobs < 0 || memoryMB < 0 {
+		fmt.Println("--jobs and --memory cannot be negative")
+		os.Exit(exitUsage)
+	}
+	opts.memoryBudget = int64(memoryMB) << 20
+	if showProgress {
+		opts.progress = progressPrinter(os.Stderr)
+	}
+	if encryptFlag != "" && decryptFlag != "" {
+		fmt.Println("cannot perform both encrypt and decrypt in one run")
+		os.Exit(exitUsage)
+	}
+	switch {
+	case passwordEnv != "":
+		opts.keyProvider = &encryptor.EnvKeyProvider{Name: passwordEnv}
+	case passwordFile != "":
+		opts.keyProvider = &encryptor.FileKeyProvider{Path: passwordFile}
+	case passwordFD >= 0:
+		opts.keyProvider = &encryptor.FDKeyProvider{FD: uintptr(passwordFD)}
+	case passwordCommand != "":
+		opts.keyProvider = &encryptor.CommandKeyProvider{Command: passwordCommand}
+	case pinentryProgram != "":
+		opts.keyProvider = &encryptor.PinentryKeyProvider{Program: pinentryProgram, Title: "goCryptor", Description: "Enter the goCryptor password"}
+	case askpassProgram != "":
+		opts.keyProvider = &encryptor.AskpassKeyProvider{Program: askpassProgram}
+	}
+	if encryptFlag != "" {
+		opts.action, opts.fileName = "encrypt", encryptFlag
+	}
+	if decryptFlag != "" {
+		opts.action, opts.fileName = "decrypt", decryptFlag
+	}
+	return opts
+}
+
+// runCommand runs a headless subcommand and returns the process exit code
+func runCommand(logger *log.Logger, opts *options) int {
+	if opts.command == "agent" && opts.agentOp != "" {
+		return runAgentOp(opts.socketPath, opts.agentOp, opts.agentSecret)
+	}
+	if opts.command == "agent" {
+		return runAgent(logger, opts.socketPath, opts.agentTimeout, opts.agentForeground)
+	}
+	// "-" reads from stdin or writes to stdout so goCryptor can sit in a pipeline
+	streaming := opts.fileName == "-" || opts.output == "-"
+	isDir := false
+	if opts.fileName != "-" {
+		var err error
+		isDir, err = validateFileName(opts.fileName)
+		if err != nil {
+			logger.Println("Validation error: ", err)
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			return exitUsage
+		}
+	} else if opts.command == "info" {
+		fmt.Fprintln(os.Stderr, "Error: info needs a file path")
+		return exitUsage
+	}
+	if err := validateOutput(opts, isDir); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return exitUsage
+	}
+	if opts.command == "info" {
+		return runInfo(opts.fileName, opts.jsonOutput)
+	}
+	if opts.dryRun {
+		if streaming {
+			fmt.Fprintln(os.Stderr, "Error: --dry-run needs a file or folder, not a stream")
+			return exitUsage
+		}
+		return runDryRun(context.Background(), opts, isDir, newReporter(opts.jsonOutput, os.Stdout, opts.command))
+	}
+	// explicit password sources win, otherwise a running agent is asked before prompting
+	agentClient := agent.NewClient()
+	provider := opts.keyProvider
+	if provider == nil {
+		provider = &agent.KeyProvider{Client: agentClient, Fallback: &encryptor.PromptKeyProvider{}}
+	}
+	password, err := provider.Password(opts.command == "encrypt")
+	if err != nil {
+		logger.Println("Password error: ", err)
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return exitNoPassword
+	}
+	// the first interrupt abandons the files in progress, removing their partial output, a second one
+	// kills the process
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interrupts
+		signal.Stop(interrupts)
+		cancel()
+	}()
+	var wrapper *encryptor.PasswordWrapper
+	if opts.command == "encrypt" && isDir {
+		// stretch the password once for the whole folder, each file gets its own key from it
+		wrapper, err = encryptor.NewBatchPasswordWrapper(password, agentClient)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			return exitFailure
+		}
+	} else {
+		wrapper = encryptor.NewPasswordWrapper(password, agentClient)
+	}
+	if streaming {
+		// the results go to stderr when stdout is carrying the data
+		resultsOut := os.Stdout
+		if opts.command != "verify" && (opts.output == "" || opts.output == "-") {
+			resultsOut = os.Stderr
+		}
+		report := newReporter(opts.jsonOutput, resultsOut, opts.command)
+		code := runStream(ctx, logger, report, opts.command, wrapper, opts.fileName, opts.output, opts.conflict)
+		report.finish(code)
+		if code == exitOK && opts.rememberPassword {
+			agentClient.Put(agent.PasswordName, []byte(password))
+		}
+		return code
+	}
+	code := exitOK
+	report := newReporter(opts.jsonOutput, os.Stdout, opts.command)
+	err = runBatch(ctx, opts, wrapper, isDir, func(res fileResult) {
+		code = worseExitCode(code, res.Code)
+		if res.Error != "" {
+			logger.Printf("Error processing file: %s err: %s", res.Path, res.Error)
+		} else if res.Warning != "" {
+			logger.Printf("Warning for file: %s: %s", res.Path, res.Warning)
+		} else {
+			logger.Printf("Success %s file: %s", opts.command, res.Path)
+		}
+		report.file(res)
+	})
+	if err != nil {
+		logger.Println("Walk dir err: ", err)
+		report.walkError(err)
+		code = worseExitCode(code, exitCodeFor(err))
+	}
+	report.finish(code)
+	// the derived keys are already cached, the password itself only when asked to
+	if code == exitOK && opts.rememberPassword {
+		agentClient.Put(agent.PasswordName, []byte(password))
+	}
+	return code
+}
+
+// validateOutput rejects output options that cannot apply to the input
+func validateOutput(opts *options, isDir bool) error {
+	if opts.output != "" && opts.outputDir != "" {
+		return errors.New("use either --output or --output-dir, not both")
+	}
+	if opts.output != "" && isDir {
+		return errors.New("--output needs a single file, use --output-dir for a folder")
+	}
+	if opts.outputDir != "" && opts.fileName == "-" {
+		return errors.New("--output-dir needs a file or folder, use --output with stdin")
+	}
+	if opts.dispose != encryptor.DispositionKeep && (opts.fileName == "-" || opts.output == "-") {
+		return errors.New("--dispose needs a file or folder written to a file, not a stream")
+	}
+	return nil
+}
+
+// outputDirFor returns the folder a result for path belongs in, inside a folder the relative
+// layout below the root is recreated under the output directory
+func outputDirFor(opts *options, path string, isDir bool) (string, error) {
+	if opts.outputDir == "" {
+		return filepath.Dir(path), nil
+	}
+	if !isDir {
+		return opts.outputDir, nil
+	}
+	rel, err := filepath.Rel(opts.fileName, filepath.Dir(path))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(opts.outputDir, rel), nil
+}
+
+// outputPath returns where the encrypted copy of path is written
+func outputPath(opts *options, path string, isDir bool) (string, error) {
+	if opts.output != "" {
+		return opts.output, nil
+	}
+	dir, err := outputDirFor(opts, path, isDir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, filepath.Base(encryptor.EncryptedName(path))), nil
+}
+
+// runStream encrypts, decrypts or verifies input writing any output to output, either may be "-"
+// for stdin or stdout and an empty output also means stdout
+func runStream(ctx context.Context, logger *log.Logger, report *reporter, command string, wrapper encryptor.KeyWrapper, input, output string, conflict encryptor.ConflictPolicy) int {
+	start := time.Now()
+	res := fileResult{Path: input, Action: command, Output: output}
+	if command == "verify" {
+		res.Output = ""
+	} else if output == "" {
+		res.Output = "-"
+	}
+	fail := func(err error) int {
+		logger.Printf("Error processing %s: %s", input, err)
+		res.Output, res.Error, res.Code = "", err.Error(), exitCodeFor(err)
+		res.DurationMS = time.Since(start).Milliseconds()
+		report.file(res)
+		return res.Code
+	}
+	counted := &countingReader{r: os.Stdin}
+	if input != "-" {
+		f, err := os.Open(input)
+		if err != nil {
+			return fail(err)
+		}
+		defer f.Close()
+		counted.r = f
+	}
+	var dest io.Writer = os.Stdout
+	var atomicOut *encryptor.AtomicFile
+	if res.Output != "" && res.Output != "-" {
+		var err error
+		// a decrypted stream has no stored mode, it is made readable only by the user
+		perm := os.FileMode(0644)
+		if command == "decrypt" {
+			perm = 0600
+		}
+		atomicOut, err = encryptor.CreateOutput(output, perm, conflict, nil)
+		if err == encryptor.ErrSkipped {
+			res.Output, res.Skipped = "", "output exists"
+			report.file(res)
+			return exitOK
+		}
+		if err != nil {
+			return fail(err)
+		}
+		res.Output = atomicOut.Target()
+		dest = atomicOut
+	}
+	out := bufio.NewWriter(dest)
+	var err error
+	switch command {
+	case "encrypt":
+		ext := ""
+		if input != "-" {
+			ext = filepath.Ext(input)
+		}
+		err = encryptor.EncryptContext(ctx, out, counted, &encryptor.Options{Wrapper: wrapper, Ext: ext})
+	case "decrypt":
+		_, err = encryptor.DecryptContext(ctx, out, counted, &encryptor.Options{Wrapper: wrapper})
+	case "verify":
+		_, err = encryptor.DecryptContext(ctx, ioutil.Discard, counted, &encryptor.Options{Wrapper: wrapper})
+	}
+	if err == nil {
+		err = out.Flush()
+	}
+	if atomicOut != nil {
+		if err == nil {
+			err = atomicOut.Commit()
+		} else {
+			atomicOut.Abort()
+		}
+	}
+	res.Bytes = counted.n
+	if err != nil {
+		return fail(err)
+	}
+	logger.Printf("Success %s %s", command, input)
+	res.DurationMS = time.Since(start).Milliseconds()
+	// a stream only gets a line of text output in JSON mode, stdout may be the data
+	if report.json {
+		report.file(res)
+	}
+	return exitOK
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// forEachFile calls fn for the file, or every regular file below the folder that passes the filter.
+// In a folder files are told apart by content, encrypted selects goCryptor files rather than the
+// files that are not, and patterns are matched against the name without .gcx. skip, if not nil,
+// is told about each file or folder left out and why.
+func forEachFile(root string, isDir bool, encrypted bool, filter *fileFilter, fn func(path string), skip func(path, reason string)) error {
+	if skip == nil {
+		skip = func(string, string) {}
+	}
+	if !isDir {
+		fn(root)
+		return nil
+	}
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if info.IsDir() {
+			if path != root && filter.excluded(rel, true) {
+				skip(path, "excluded folder")
+				return filepath.SkipDir
+			}
+			if path == root {
+				rel = ""
+			}
+			return filter.loadIgnoreFile(rel, path)
+		}
+		if info.Name() == ignoreFileName {
+			return nil
+		}
+		if encrypted {
+			rel = strings.TrimSuffix(rel, ".gcx")
+		}
+		if filter.excluded(rel, false) {
+			skip(path, "excluded")
+			return nil
+		}
+		if !filter.included(rel) {
+			skip(path, "not included")
+			return nil
+		}
+		// a file that cannot be read is left for fn to report when encrypting
+		isEncrypted, err := encryptor.IsEncryptedFile(path)
+		if err != nil {
+			isEncrypted = false
+		}
+		if isEncrypted != encrypted {
+			if isEncrypted {
+				skip(path, "already encrypted")
+			} else {
+				skip(path, "not encrypted")
+			}
+			return nil
+		}
+		fn(path)
+		return nil
+	})
+}
+
+// checkNotEncrypted refuses to encrypt goCryptor output a second time
+func checkNotEncrypted(path string) error {
+	isEncrypted, err := encryptor.IsEncryptedFile(path)
+	if err == nil && isEncrypted {
+		return errors.New("file is already encrypted")
+	}
+	return nil
+}
+
+// runInfo prints what the header says about an encrypted file
+func runInfo(fileName string, jsonOutput bool) int {
+	info, err := encryptor.Inspect(fileName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return exitFailure
+	}
+	if jsonOutput {
+		json.NewEncoder(os.Stdout).Encode(struct {
+			Path string `json:"path"`
+			*encryptor.Info
+		}{fileName, info})
+		return exitOK
+	}
+	fmt.Println("File:", fileName)
+	fmt.Println("Format version:", info.Version)
+	fmt.Println("Cipher:", info.Cipher)
+	if info.ChunkSize > 0 {
+		fmt.Println("Chunk size:", info.ChunkSize)
+	}
+	fmt.Println("Original extension:", info.Ext)
+	keys := make([]string, 0, len(info.Metadata))
+	for key := range info.Metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Printf("Metadata: %s=%s\n", key, info.Metadata[key])
+	}
+	fmt.Println("Header size:", info.HeaderSize)
+	fmt.Println("Payload size:", info.PayloadSize)
+	fmt.Println("Plaintext size:", info.PlaintextSize)
+	fmt.Println("Key slots:", info.KeySlotCount)
+	for i, slot := range info.KeySlots {
+		fmt.Printf("Key slot %d: %s %s\n", i, slot.Type, slot.KeyID)
+		if slot.KDF != nil {
+			fmt.Printf("  KDF: scrypt N=%d r=%d p=%d\n", slot.KDF.N, slot.KDF.R, slot.KDF.P)
+		}
+		if len(slot.Salt) > 0 {
+			fmt.Printf("  Salt: %x\n", slot.Salt)
+		}
+		if len(slot.FileSalt) > 0 {
+			fmt.Printf("  File salt: %x\n", slot.FileSalt)
+		}
+	}
+	return exitOK
+}
+
+// agentDetachedEnv marks the copy of goCryptor that runAgent starts in the background
+const agentDetachedEnv = "GOCRYPTOR_AGENT_DETACHED"
+
+// runAgentOp asks the agent at socketPath to forget secrets: clear forgets all of them, delete the one
+// named, or the remembered password when no name is given
+func runAgentOp(socketPath, op, name string) int {
+	client := &agent.Client{SocketPath: socketPath}
+	var err error
+	if op == "clear" {
+		err = client.Clear()
+	} else {
+		if name == "" {
+			name = agent.PasswordName
+		}
+		err = client.Delete(name)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return exitFailure
+	}
+	return exitOK
+}
+
+// runAgent serves the key agent until it is stopped, printing the socket in ssh-agent style so it can
+// be eval'd. Unless foreground is set it first moves to the background. Without a socket path the
+// socket goes in a new folder only the user can open, which is removed again when the agent stops.
+func runAgent(logger *log.Logger, socketPath string, timeout time.Duration, foreground bool) int {
+	detached := os.Getenv(agentDetachedEnv) != ""
+	if !foreground && !detached {
+		return detachAgent(socketPath, timeout)
+	}
+	tempDir := ""
+	if socketPath == "" {
+		var err error
+		socketPath, err = agent.TempSocketPath()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "agent error:", err)
+			return exitFailure
+		}
+		tempDir = filepath.Dir(socketPath)
+		defer os.Remove(tempDir)
+	}
+	listener, err := agent.Listen(socketPath)
+	if err != nil {
+		logger.Println("agent error: ", err)
+		fmt.Fprintln(os.Stderr, "agent error:", err)
+		return exitFailure
+	}
+	fmt.Printf("GOCRYPTOR_AGENT_SOCK=%s; export GOCRYPTOR_AGENT_SOCK;\n", socketPath)
+	logger.Println("Starting agent on socket: ", socketPath)
+	if detached {
+		// $(goCryptor agent) waits until every copy of its stdout is closed
+		os.Stdout.Close()
+		os.Stderr.Close()
+	}
+	// closing the listener removes the socket
+	stopped := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		<-signals
+		close(stopped)
+		listener.Close()
+	}()
+	err = agent.New(timeout).Serve(listener)
+	select {
+	case <-stopped:
+		logger.Println("Agent stopped")
+		return exitOK
+	default:
+	}
+	listener.Close()
+	logger.Println("agent error: ", err)
+	fmt.Fprintln(os.Stderr, "agent error:", err)
+	return exitFailure
+}
+
+// detachAgent starts the agent again in a session of its own and passes on what it prints once it
+// is listening, so eval $(goCryptor agent) carries on while the agent keeps running
+func detachAgent(socketPath string, timeout time.Duration) int {
+	self, err := os.Executable()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "agent error:", err)
+		return exitFailure
+	}
+	args := []string{"agent", "--timeout", timeout.String()}
+	if socketPath != "" {
+		args = append(args, "--socket", socketPath)
+	}
+	cmd := exec.Command(self, args...)
+	cmd.Env = append(os.Environ(), agentDetachedEnv+"=1")
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = detachedProcess()
+	out, err := cmd.StdoutPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "agent error: unable to start in the background:", err)
+		return exitFailure
+	}
+	settings, _ := ioutil.ReadAll(out)
+	if len(settings) == 0 {
+		// the agent did not start and has said why on stderr
+		cmd.Wait()
+		return exitFailure
+	}
+	os.Stdout.Write(settings)
+	cmd.Process.Release()
+	return exitOK
+}
+
+func exitCodeFor(err error) int {
+	switch err {
+	case encryptor.ErrWrongKey:
+		return exitWrongKey
+	case encryptor.ErrCorrupt:
+		return exitCorrupt
+	case context.Canceled:
+		return exitCancelled
+	}
+	return exitFailure
+}
+
+// worseExitCode keeps the most specific failure seen, corruption outranks a wrong key which outranks
+// other failures. An input left over is only reported when nothing failed.
+func worseExitCode(current, next int) int {
+	if next == exitDisposeFailed && current != exitOK || current == exitDisposeFailed && next == exitOK {
+		return current
+	}
+	if current == exitDisposeFailed || next > current {
+		return next
+	}
+	return current
+}
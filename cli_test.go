@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestWorseExitCode(t *testing.T) {
+	cases := []struct {
+		current, next, want int
+	}{
+		{exitOK, exitOK, exitOK},
+		{exitOK, exitFailure, exitFailure},
+		{exitFailure, exitCorrupt, exitCorrupt},
+		{exitCorrupt, exitWrongKey, exitCorrupt},
+		{exitOK, exitDisposeFailed, exitDisposeFailed},
+		{exitDisposeFailed, exitOK, exitDisposeFailed},
+		// any failure outranks an input left over
+		{exitDisposeFailed, exitFailure, exitFailure},
+		{exitFailure, exitDisposeFailed, exitFailure},
+		{exitWrongKey, exitDisposeFailed, exitWrongKey},
+		{exitDisposeFailed, exitCancelled, exitCancelled},
+	}
+	for _, c := range cases {
+		if got := worseExitCode(c.current, c.next); got != c.want {
+			t.Errorf("worseExitCode(%d, %d) = %d, want %d", c.current, c.next, got, c.want)
+		}
+	}
+}
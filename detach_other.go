@@ -0,0 +1,10 @@
+// +build !linux,!darwin,!freebsd,!openbsd,!netbsd,!dragonfly
+
+package main
+
+import "syscall"
+
+// detachedProcess has nothing to add where there are no Unix sessions
+func detachedProcess() *syscall.SysProcAttr {
+	return nil
+}
@@ -0,0 +1,10 @@
+// +build linux darwin freebsd openbsd netbsd dragonfly
+
+package main
+
+import "syscall"
+
+// detachedProcess starts a process in a session of its own so it outlives the terminal
+func detachedProcess() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
@@ -0,0 +1,139 @@
+package encryptor
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// AtomicFile is written in a temporary file beside the target and only renamed over it once complete,
+// so a crash or full disk never leaves a half written target or destroys the previous one
+type AtomicFile struct {
+	*os.File
+	target string
+	// perm is the mode Commit gives the file, until then only the user can read it
+	perm os.FileMode
+	// claimed means target is a placeholder holding the name, which Abort removes
+	claimed bool
+}
+
+// CreateAtomic starts writing path, nothing is visible at path until Commit. The temporary file is
+// readable only by the user while it is written, Commit gives it perm less the umask.
+func CreateAtomic(path string, perm os.FileMode) (*AtomicFile, error) {
+	dir, base := filepath.Split(path)
+	suffix := make([]byte, 6)
+	for i := 0; i < 100; i++ {
+		_, err := rand.Read(suffix)
+		if err != nil {
+			return nil, errors.New("random data read error: " + err.Error())
+		}
+		// hidden and in the same folder so the rename cannot cross filesystems
+		tmp := filepath.Join(dir, "."+base+"."+hex.EncodeToString(suffix)+".tmp")
+		f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &AtomicFile{File: f, target: path, perm: perm.Perm() &^ umask}, nil
+	}
+	return nil, errors.New("unable to create a temporary file for " + path)
+}
+
+// CreateOutput starts writing outputFile like CreateAtomic once the conflict policy has been applied,
+// Target gives the name it settled on. Except under ConflictOverwrite the name is claimed straight
+// away with an empty placeholder, which Commit replaces and Abort removes, so nothing that appears
+// at the name meanwhile is ever replaced. ErrSkipped and ErrExists are returned as they are.
+func CreateOutput(outputFile string, perm os.FileMode, policy ConflictPolicy, ask func(path string) ConflictPolicy) (*AtomicFile, error) {
+	target, claimed, err := claimOutput(outputFile, policy, ask)
+	if err != nil {
+		return nil, err
+	}
+	f, err := CreateAtomic(target, perm)
+	if err != nil {
+		if claimed {
+			os.Remove(target)
+		}
+		return nil, err
+	}
+	f.claimed = claimed
+	return f, nil
+}
+
+// SetPerm makes Commit give the file exactly perm, the umask is not applied
+func (f *AtomicFile) SetPerm(perm os.FileMode) {
+	f.perm = perm.Perm()
+}
+
+// Target is the path Commit writes to
+func (f *AtomicFile) Target() string {
+	return f.target
+}
+
+// Commit sets the file's mode, flushes the data to disk and renames the temporary file over the target
+func (f *AtomicFile) Commit() error {
+	err := f.Chmod(f.perm)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Abort()
+		return err
+	}
+	err = f.File.Close()
+	if err != nil {
+		os.Remove(f.Name())
+		f.removeClaim()
+		return err
+	}
+	err = os.Rename(f.Name(), f.target)
+	if err != nil {
+		os.Remove(f.Name())
+		f.removeClaim()
+		return err
+	}
+	syncDir(filepath.Dir(f.target))
+	return nil
+}
+
+// Abort discards the temporary file, leaving any existing target untouched
+func (f *AtomicFile) Abort() {
+	f.File.Close()
+	os.Remove(f.Name())
+	f.removeClaim()
+}
+
+// removeClaim removes the placeholder holding the target's name, if there is one
+func (f *AtomicFile) removeClaim() {
+	if f.claimed {
+		os.Remove(f.target)
+		f.claimed = false
+	}
+}
+
+// syncDir makes the rename durable, it is not possible everywhere (for example on Windows) so errors are ignored
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
+
+// writeFileAtomic writes data to path through a temporary file
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	f, err := CreateAtomic(path, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err != nil {
+		f.Abort()
+		return err
+	}
+	return f.Commit()
+}
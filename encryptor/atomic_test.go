@@ -0,0 +1,146 @@
+package encryptor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"testing"
+)
+
+func folderNames(t *testing.T, dir string) []string {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sameNames(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestCreateOutput(t *testing.T) {
+	cases := []struct {
+		name   string
+		policy ConflictPolicy
+		// exists puts out.txt in the folder first
+		exists bool
+		target string
+		// placeholder is whether the target is held while writing
+		placeholder bool
+	}{
+		{"overwrite a free name", ConflictOverwrite, false, "out.txt", false},
+		{"overwrite", ConflictOverwrite, true, "out.txt", false},
+		{"fail on a free name", ConflictFail, false, "out.txt", true},
+		{"skip on a free name", ConflictSkip, false, "out.txt", true},
+		{"number on a free name", ConflictNumber, false, "out.txt", true},
+		{"number", ConflictNumber, true, "out (1).txt", true},
+	}
+	for _, c := range cases {
+		for _, commit := range []bool{false, true} {
+			dir := conflictFolder(t, false)
+			if !c.exists {
+				os.Remove(filepath.Join(dir, "out.txt"))
+			}
+			before := folderNames(t, dir)
+			f, err := CreateOutput(filepath.Join(dir, "out.txt"), 0644, c.policy, nil)
+			if err != nil {
+				t.Fatalf("%s: %v", c.name, err)
+			}
+			target := filepath.Join(dir, c.target)
+			if f.Target() != target {
+				t.Fatalf("%s: target %q, want %q", c.name, f.Target(), target)
+			}
+			if filepath.Dir(f.Name()) != dir || f.Name() == target {
+				t.Fatalf("%s: temporary file %q is not beside the target", c.name, f.Name())
+			}
+			info, err := os.Lstat(target)
+			if c.placeholder && (err != nil || info.Size() != 0) {
+				t.Fatalf("%s: the name is not held by an empty placeholder: %v", c.name, err)
+			}
+			f.Write([]byte("new"))
+			if !commit {
+				f.Abort()
+				// the temporary file and any placeholder are gone, an existing target is untouched
+				if after := folderNames(t, dir); !sameNames(after, before) {
+					t.Fatalf("%s: abort left %v, the folder had %v", c.name, after, before)
+				}
+				if c.exists {
+					data, _ := ioutil.ReadFile(filepath.Join(dir, "out.txt"))
+					if string(data) != "existing" {
+						t.Fatalf("%s: abort changed the existing file", c.name)
+					}
+				}
+				continue
+			}
+			err = f.Commit()
+			if err != nil {
+				t.Fatalf("%s: commit: %v", c.name, err)
+			}
+			data, err := ioutil.ReadFile(target)
+			if err != nil || string(data) != "new" {
+				t.Fatalf("%s: target holds %q, %v", c.name, data, err)
+			}
+			if info, _ := os.Stat(target); runtime.GOOS != "windows" && info.Mode().Perm() != 0644&^umask {
+				t.Fatalf("%s: mode %v, want %v", c.name, info.Mode().Perm(), os.FileMode(0644&^umask))
+			}
+			// only the target was added
+			want := append([]string(nil), before...)
+			if !c.exists || c.target != "out.txt" {
+				want = append(want, c.target)
+				sort.Strings(want)
+			}
+			if after := folderNames(t, dir); !sameNames(after, want) {
+				t.Fatalf("%s: commit left %v, want %v", c.name, after, want)
+			}
+		}
+	}
+}
+
+func TestCreateOutputRefused(t *testing.T) {
+	for _, policy := range []ConflictPolicy{ConflictSkip, ConflictFail} {
+		dir := conflictFolder(t, false)
+		before := folderNames(t, dir)
+		_, err := CreateOutput(filepath.Join(dir, "out.txt"), 0644, policy, nil)
+		if err != ErrSkipped && err != ErrExists {
+			t.Fatalf("%v: got %v", policy, err)
+		}
+		if after := folderNames(t, dir); !sameNames(after, before) {
+			t.Fatalf("%v: left %v behind", policy, after)
+		}
+	}
+}
+
+func TestCreateOutputNumbersConcurrentWriters(t *testing.T) {
+	dir := conflictFolder(t, false)
+	path := filepath.Join(dir, "out.txt")
+	// neither has written anything yet, the placeholders alone keep them apart
+	first, err := CreateOutput(path, 0644, ConflictNumber, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := CreateOutput(path, 0644, ConflictNumber, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Target() != filepath.Join(dir, "out (1).txt") || second.Target() != filepath.Join(dir, "out (2).txt") {
+		t.Fatalf("got %q and %q", first.Target(), second.Target())
+	}
+	first.Abort()
+	second.Abort()
+}
@@ -0,0 +1,108 @@
+package encryptor
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+)
+
+// attrsNonceFlag marks the nonce used to seal the attributes, chunk nonces only use 0 and 1 in that byte
+const attrsNonceFlag = 2
+
+// FileAttrs are file system attributes kept in the header, sealed with the data key, so decrypting
+// can restore them
+type FileAttrs struct {
+	// Mode holds the permission bits
+	Mode       os.FileMode `json:"mode"`
+	ModTime    time.Time   `json:"mtime"`
+	AccessTime time.Time   `json:"atime"`
+	// UID and GID are only kept when ownership is asked for
+	UID *int `json:"uid,omitempty"`
+	GID *int `json:"gid,omitempty"`
+	// Xattrs are only kept when asked for and where the platform supports them
+	Xattrs map[string][]byte `json:"xattrs,omitempty"`
+}
+
+// ReadFileAttrs reads the mode and times of path, and its extended attributes and owner when asked for
+func ReadFileAttrs(path string, xattrs, owner bool) (*FileAttrs, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	attrs := &FileAttrs{Mode: info.Mode().Perm(), ModTime: info.ModTime(), AccessTime: info.ModTime()}
+	readPlatformAttrs(path, attrs, owner)
+	if xattrs {
+		attrs.Xattrs, err = readXattrs(path)
+		if err != nil {
+			return nil, errors.New("unable to read extended attributes: " + err.Error())
+		}
+	}
+	return attrs, nil
+}
+
+// applyAttrs sets the mode Commit gives the file, and the owner and extended attributes when asked
+// for, while it is still being written. Owner and extended attributes that cannot be set, for example
+// without privileges, are skipped.
+func applyAttrs(f *AtomicFile, attrs *FileAttrs, xattrs, owner bool) {
+	f.SetPerm(attrs.Mode)
+	if owner && attrs.UID != nil && attrs.GID != nil {
+		f.Chown(*attrs.UID, *attrs.GID)
+	}
+	if xattrs {
+		writeXattrs(f.Name(), attrs.Xattrs)
+	}
+}
+
+// applyTimes sets the access and modification times once the file is complete
+func applyTimes(path string, attrs *FileAttrs) error {
+	atime := attrs.AccessTime
+	if atime.IsZero() {
+		atime = attrs.ModTime
+	}
+	err := os.Chtimes(path, atime, attrs.ModTime)
+	if err != nil {
+		return errors.New("unable to set file times: " + err.Error())
+	}
+	return nil
+}
+
+// sealAttrs encrypts the attributes with the data key under a nonce no chunk uses
+func sealAttrs(h *header, dataKey []byte, attrs *FileAttrs) ([]byte, error) {
+	plain, err := json.Marshal(attrs)
+	if err != nil {
+		return nil, errors.New("attribute encode error: " + err.Error())
+	}
+	aead, err := newAEAD(h.Cipher, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nil, attrsNonce(h.Nonce), plain, nil), nil
+}
+
+// openAttrs reverses sealAttrs, returning nil if the file has no attributes
+func openAttrs(h *header, dataKey []byte) (*FileAttrs, error) {
+	if len(h.Attrs) == 0 {
+		return nil, nil
+	}
+	aead, err := newAEAD(h.Cipher, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := aead.Open(nil, attrsNonce(h.Nonce), h.Attrs, nil)
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	attrs := &FileAttrs{}
+	err = json.Unmarshal(plain, attrs)
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	return attrs, nil
+}
+
+func attrsNonce(prefix []byte) []byte {
+	nonce := chunkNonce(prefix, 0, false)
+	nonce[nonceLength-1] = attrsNonceFlag
+	return nonce
+}
@@ -0,0 +1,10 @@
+// +build !linux,!darwin,!freebsd,!openbsd,!netbsd,!dragonfly
+
+package encryptor
+
+// umask is not applied where there is none
+const umask = 0
+
+// readPlatformAttrs is a no-op where there is no access time or owner to read, the access time
+// stays at the modification time
+func readPlatformAttrs(path string, attrs *FileAttrs, owner bool) {}
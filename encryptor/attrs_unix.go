@@ -0,0 +1,34 @@
+// +build linux darwin freebsd openbsd netbsd dragonfly
+
+package encryptor
+
+import (
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// umask is read once while the package is initialised, when nothing else can be creating files,
+// since reading it means changing it
+var umask = readUmask()
+
+func readUmask() os.FileMode {
+	old := unix.Umask(0)
+	unix.Umask(old)
+	return os.FileMode(old)
+}
+
+// readPlatformAttrs adds the access time, and the owner when asked for
+func readPlatformAttrs(path string, attrs *FileAttrs, owner bool) {
+	var st unix.Stat_t
+	if unix.Stat(path, &st) != nil {
+		return
+	}
+	sec, nsec := st.Atim.Unix()
+	attrs.AccessTime = time.Unix(sec, nsec)
+	if owner {
+		uid, gid := int(st.Uid), int(st.Gid)
+		attrs.UID, attrs.GID = &uid, &gid
+	}
+}
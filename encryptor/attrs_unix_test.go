@@ -0,0 +1,157 @@
+// +build linux darwin freebsd openbsd netbsd dragonfly
+
+package encryptor
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// attrsFile writes plain.txt with the mode and modification time
+func attrsFile(t *testing.T, mode os.FileMode, mtime time.Time) (string, string) {
+	dir, err := ioutil.TempDir("", "gocryptor-attrs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	plain := filepath.Join(dir, "plain.txt")
+	err = ioutil.WriteFile(plain, []byte("attributes"), 0600)
+	if err == nil {
+		err = os.Chmod(plain, mode)
+	}
+	if err == nil {
+		err = os.Chtimes(plain, mtime, mtime)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, plain
+}
+
+func fileMode(t *testing.T, path string) os.FileMode {
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Mode().Perm()
+}
+
+func TestNoAttrsUsesUmask(t *testing.T) {
+	saved := umask
+	defer func() { umask = saved }()
+	mtime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	for _, mask := range []os.FileMode{0, 0022, 0027, 0077} {
+		umask = mask
+		dir, plain := attrsFile(t, 0666, mtime)
+		sealed, err := EncryptFileContext(context.Background(), plain, plain+".gcx", &Options{Password: "pw", KDF: testKDF, NoAttrs: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fileMode(t, sealed); got != 0644&^mask {
+			t.Fatalf("umask %o: encrypted file mode %o, want %o", mask, got, 0644&^mask)
+		}
+		// nothing is stored, the plaintext gets the private default less the umask and the time it was written
+		result, err := DecryptFileContext(context.Background(), sealed, filepath.Join(dir, "out.txt"), &Options{Password: "pw"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Attrs != nil {
+			t.Fatalf("umask %o: attributes were stored with NoAttrs", mask)
+		}
+		if got := fileMode(t, result.Output); got != 0600&^mask {
+			t.Fatalf("umask %o: decrypted file mode %o, want %o", mask, got, 0600&^mask)
+		}
+		if info, _ := os.Stat(result.Output); info.ModTime().Equal(mtime) {
+			t.Fatalf("umask %o: the modification time was restored", mask)
+		}
+	}
+}
+
+func TestAttrsRoundTrip(t *testing.T) {
+	// the modes are restored exactly, the umask only applies to files without stored attributes
+	mtime := time.Date(2001, 2, 3, 4, 5, 6, 789000000, time.UTC)
+	atime := time.Date(2002, 3, 4, 5, 6, 7, 0, time.UTC)
+	for _, mode := range []os.FileMode{0400, 0600, 0640, 0666, 0755} {
+		dir, plain := attrsFile(t, mode, mtime)
+		err := os.Chtimes(plain, atime, mtime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sealed, err := EncryptFileContext(context.Background(), plain, plain+".gcx", &Options{Password: "pw", KDF: testKDF})
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := DecryptFileContext(context.Background(), sealed, filepath.Join(dir, "out.txt"), &Options{Password: "pw"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Attrs == nil || result.Attrs.Mode != mode || !result.Attrs.ModTime.Equal(mtime) {
+			t.Fatalf("mode %o: stored attributes %+v", mode, result.Attrs)
+		}
+		if got := fileMode(t, result.Output); got != mode {
+			t.Fatalf("mode %o: restored as %o", mode, got)
+		}
+		var st unix.Stat_t
+		err = unix.Stat(result.Output, &st)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := time.Unix(st.Mtim.Unix()); !got.Equal(mtime) {
+			t.Fatalf("mode %o: modification time %v, want %v", mode, got, mtime)
+		}
+		if got := time.Unix(st.Atim.Unix()); !got.Equal(atime) {
+			t.Fatalf("mode %o: access time %v, want %v", mode, got, atime)
+		}
+
+		// NoAttrs when decrypting ignores what was stored
+		result, err = DecryptFileContext(context.Background(), sealed, filepath.Join(dir, "bare.txt"), &Options{Password: "pw", NoAttrs: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fileMode(t, result.Output); got != 0600&^umask {
+			t.Fatalf("mode %o with NoAttrs: restored as %o, want %o", mode, got, 0600&^umask)
+		}
+	}
+}
+
+func TestOwnerRoundTrip(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("needs root to give files away")
+	}
+	dir, plain := attrsFile(t, 0644, time.Now())
+	err := os.Chown(plain, 65534, 65534)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := EncryptFileContext(context.Background(), plain, plain+".gcx", &Options{Password: "pw", KDF: testKDF, Ownership: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, owner := range []bool{false, true} {
+		output := filepath.Join(dir, "out.txt")
+		os.Remove(output)
+		_, err = DecryptFileContext(context.Background(), sealed, output, &Options{Password: "pw", Ownership: owner})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var st unix.Stat_t
+		err = unix.Stat(output, &st)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the owner is only restored when asked for
+		want := uint32(0)
+		if owner {
+			want = 65534
+		}
+		if st.Uid != want || st.Gid != want {
+			t.Fatalf("ownership %v: owned by %d:%d, want %d", owner, st.Uid, st.Gid, want)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package encryptor
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ConflictPolicy decides what happens when an output file already exists
+type ConflictPolicy int
+
+const (
+	// ConflictOverwrite replaces the existing file
+	ConflictOverwrite ConflictPolicy = iota
+	// ConflictSkip leaves the existing file alone and returns ErrSkipped
+	ConflictSkip
+	// ConflictNumber writes to the first free name of the form "name (1).ext"
+	ConflictNumber
+	// ConflictFail returns ErrExists
+	ConflictFail
+	// ConflictAsk calls Options.Ask to choose one of the other policies
+	ConflictAsk
+)
+
+var (
+	// ErrExists means the output file exists and the conflict policy is to fail
+	ErrExists = errors.New("output file already exists")
+	// ErrSkipped means the output file exists and the conflict policy is to skip
+	ErrSkipped = errors.New("output file already exists, skipped")
+)
+
+var conflictPolicyNames = []string{"overwrite", "skip", "number", "fail", "ask"}
+
+// String returns the name used on the command line
+func (p ConflictPolicy) String() string {
+	if p < 0 || int(p) >= len(conflictPolicyNames) {
+		return fmt.Sprintf("ConflictPolicy(%d)", int(p))
+	}
+	return conflictPolicyNames[p]
+}
+
+// ParseConflictPolicy parses overwrite, skip, number, fail or ask
+func ParseConflictPolicy(name string) (ConflictPolicy, error) {
+	for i, policyName := range conflictPolicyNames {
+		if name == policyName {
+			return ConflictPolicy(i), nil
+		}
+	}
+	return 0, errors.New("unknown conflict policy: " + name + ", use one of " + strings.Join(conflictPolicyNames, ", "))
+}
+
+// ResolveConflict returns the path to write given the policy, which is outputFile unless it exists.
+// ask is only used by ConflictAsk, it is given the existing path and returns the policy to apply.
+// It only looks, another writer may take the name before it is used, CreateOutput claims it.
+func ResolveConflict(outputFile string, policy ConflictPolicy, ask func(path string) ConflictPolicy) (string, error) {
+	_, err := os.Lstat(outputFile)
+	if os.IsNotExist(err) {
+		return outputFile, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if policy == ConflictAsk {
+		if ask == nil {
+			return "", errors.New("output file exists and there is no way to ask what to do")
+		}
+		policy = ask(outputFile)
+	}
+	switch policy {
+	case ConflictOverwrite:
+		return outputFile, nil
+	case ConflictSkip:
+		return "", ErrSkipped
+	case ConflictFail:
+		return "", ErrExists
+	case ConflictNumber:
+		return NumberedName(outputFile, func(candidate string) (bool, error) {
+			_, err := os.Lstat(candidate)
+			if os.IsNotExist(err) {
+				return true, nil
+			}
+			return false, err
+		})
+	}
+	return "", errors.New("unsupported conflict policy: " + policy.String())
+}
+
+// claimOutput applies the policy to outputFile as ResolveConflict does, except that under every
+// policy but overwrite the name is taken by creating an empty placeholder exclusively. Of several
+// writers aiming at one name, in this process or another, only one gets it and the others see it
+// taken. claimed reports that a placeholder was made.
+func claimOutput(outputFile string, policy ConflictPolicy, ask func(path string) ConflictPolicy) (path string, claimed bool, err error) {
+	if policy == ConflictOverwrite {
+		return outputFile, false, nil
+	}
+	free, err := createPlaceholder(outputFile)
+	if err != nil {
+		return "", false, err
+	}
+	if free {
+		return outputFile, true, nil
+	}
+	if policy == ConflictAsk {
+		if ask == nil {
+			return "", false, errors.New("output file exists and there is no way to ask what to do")
+		}
+		policy = ask(outputFile)
+	}
+	switch policy {
+	case ConflictOverwrite:
+		return outputFile, false, nil
+	case ConflictSkip:
+		return "", false, ErrSkipped
+	case ConflictFail:
+		return "", false, ErrExists
+	case ConflictNumber:
+		path, err = NumberedName(outputFile, createPlaceholder)
+		return path, err == nil, err
+	}
+	return "", false, errors.New("unsupported conflict policy: " + policy.String())
+}
+
+// createPlaceholder creates path empty and readable only by the user if nothing is there, free is
+// false if something is
+func createPlaceholder(path string) (free bool, err error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, f.Close()
+}
+
+// NumberedName returns the first "name (n).ext" that free accepts, the number goes before the
+// original extension of an encrypted file so name.txt.gcx becomes "name (1).txt.gcx". It is how
+// ConflictNumber picks a name, exported so a dry run can pick the same one.
+func NumberedName(path string, free func(candidate string) (bool, error)) (string, error) {
+	dir, base := filepath.Split(path)
+	ext := filepath.Ext(base)
+	if ext == ".gcx" {
+		ext = filepath.Ext(strings.TrimSuffix(base, ext)) + ext
+	}
+	stem := strings.TrimSuffix(base, ext)
+	for n := 1; n < 10000; n++ {
+		candidate := filepath.Join(dir, fmt.Sprintf("%s (%d)%s", stem, n, ext))
+		ok, err := free(candidate)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return candidate, nil
+		}
+	}
+	return "", errors.New("no free numbered name for " + path)
+}
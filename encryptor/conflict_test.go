@@ -0,0 +1,185 @@
+package encryptor
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// conflictFolder holds out.txt, and "out (1).txt" when taken is set
+func conflictFolder(t *testing.T, taken bool) string {
+	dir, err := ioutil.TempDir("", "gocryptor-conflict")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	names := []string{"out.txt"}
+	if taken {
+		names = append(names, "out (1).txt")
+	}
+	for _, name := range names {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte("existing"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func answer(policy ConflictPolicy) func(string) ConflictPolicy {
+	return func(string) ConflictPolicy { return policy }
+}
+
+// conflictCases are shared by ResolveConflict and claimOutput, which must agree on the name
+var conflictCases = []struct {
+	name   string
+	output string
+	taken  bool
+	policy ConflictPolicy
+	ask    func(string) ConflictPolicy
+	// want is the name in the folder, err the error expected instead
+	want string
+	err  error
+}{
+	{"missing overwrite", "new.txt", false, ConflictOverwrite, nil, "new.txt", nil},
+	{"missing skip", "new.txt", false, ConflictSkip, nil, "new.txt", nil},
+	{"missing number", "new.txt", false, ConflictNumber, nil, "new.txt", nil},
+	{"missing fail", "new.txt", false, ConflictFail, nil, "new.txt", nil},
+	{"missing ask", "new.txt", false, ConflictAsk, nil, "new.txt", nil},
+	{"overwrite", "out.txt", false, ConflictOverwrite, nil, "out.txt", nil},
+	{"skip", "out.txt", false, ConflictSkip, nil, "", ErrSkipped},
+	{"fail", "out.txt", false, ConflictFail, nil, "", ErrExists},
+	{"number", "out.txt", false, ConflictNumber, nil, "out (1).txt", nil},
+	{"number past a taken name", "out.txt", true, ConflictNumber, nil, "out (2).txt", nil},
+	{"ask overwrite", "out.txt", false, ConflictAsk, answer(ConflictOverwrite), "out.txt", nil},
+	{"ask skip", "out.txt", false, ConflictAsk, answer(ConflictSkip), "", ErrSkipped},
+	{"ask fail", "out.txt", false, ConflictAsk, answer(ConflictFail), "", ErrExists},
+	{"ask number", "out.txt", true, ConflictAsk, answer(ConflictNumber), "out (2).txt", nil},
+	{"ask without a way to ask", "out.txt", false, ConflictAsk, nil, "", errors.New("output file exists and there is no way to ask what to do")},
+	{"ask answering ask", "out.txt", false, ConflictAsk, answer(ConflictAsk), "", errors.New("unsupported conflict policy: ask")},
+	{"unknown policy", "out.txt", false, ConflictPolicy(9), nil, "", errors.New("unsupported conflict policy: ConflictPolicy(9)")},
+}
+
+func sameError(got, want error) bool {
+	if got == nil || want == nil {
+		return got == want
+	}
+	return got == want || got.Error() == want.Error()
+}
+
+func TestResolveConflict(t *testing.T) {
+	for _, c := range conflictCases {
+		dir := conflictFolder(t, c.taken)
+		before, _ := ioutil.ReadDir(dir)
+		got, err := ResolveConflict(filepath.Join(dir, c.output), c.policy, c.ask)
+		if !sameError(err, c.err) {
+			t.Fatalf("%s: got error %v, want %v", c.name, err, c.err)
+		}
+		want := ""
+		if c.want != "" {
+			want = filepath.Join(dir, c.want)
+		}
+		if got != want {
+			t.Fatalf("%s: got %q, want %q", c.name, got, want)
+		}
+		// it only looks
+		if after, _ := ioutil.ReadDir(dir); len(after) != len(before) {
+			t.Fatalf("%s: the folder changed", c.name)
+		}
+	}
+}
+
+func TestClaimOutput(t *testing.T) {
+	for _, c := range conflictCases {
+		dir := conflictFolder(t, c.taken)
+		got, claimed, err := claimOutput(filepath.Join(dir, c.output), c.policy, c.ask)
+		if !sameError(err, c.err) {
+			t.Fatalf("%s: got error %v, want %v", c.name, err, c.err)
+		}
+		want := ""
+		if c.want != "" {
+			want = filepath.Join(dir, c.want)
+		}
+		if got != want {
+			t.Fatalf("%s: got %q, want %q", c.name, got, want)
+		}
+		// a name that was free is held by an empty placeholder, except under overwrite which never claims
+		wantClaimed := err == nil && c.policy != ConflictOverwrite && c.want != "out.txt"
+		if claimed != wantClaimed {
+			t.Fatalf("%s: claimed %v, want %v", c.name, claimed, wantClaimed)
+		}
+		if claimed {
+			info, err := os.Lstat(got)
+			if err != nil || info.Size() != 0 || (runtime.GOOS != "windows" && info.Mode().Perm() != 0600) {
+				t.Fatalf("%s: placeholder %v %v", c.name, info, err)
+			}
+		}
+		existing, _ := ioutil.ReadFile(filepath.Join(dir, "out.txt"))
+		if string(existing) != "existing" {
+			t.Fatalf("%s: the existing file was touched", c.name)
+		}
+	}
+}
+
+func TestClaimOutputOnce(t *testing.T) {
+	dir := conflictFolder(t, false)
+	path := filepath.Join(dir, "new.txt")
+	first, claimed, err := claimOutput(path, ConflictFail, nil)
+	if err != nil || !claimed || first != path {
+		t.Fatalf("first claim: %q %v %v", first, claimed, err)
+	}
+	// the placeholder makes the name taken for the next writer
+	_, _, err = claimOutput(path, ConflictFail, nil)
+	if err != ErrExists {
+		t.Fatalf("second claim: got %v, want ErrExists", err)
+	}
+	second, claimed, err := claimOutput(path, ConflictNumber, nil)
+	if err != nil || !claimed || second != filepath.Join(dir, "new (1).txt") {
+		t.Fatalf("numbered claim: %q %v %v", second, claimed, err)
+	}
+}
+
+func TestNumberedName(t *testing.T) {
+	cases := []struct {
+		path  string
+		taken int
+		want  string
+	}{
+		{"dir/a.txt", 0, "dir/a (1).txt"},
+		{"dir/a.txt", 2, "dir/a (3).txt"},
+		{"dir/a", 0, "dir/a (1)"},
+		{"dir/a", 1, "dir/a (2)"},
+		{"dir/a.tar.gz", 0, "dir/a.tar (1).gz"},
+		{"dir/a.gcx", 0, "dir/a (1).gcx"},
+		{"dir/a.txt.gcx", 0, "dir/a (1).txt.gcx"},
+		{"dir/a.txt.gcx", 1, "dir/a (2).txt.gcx"},
+		{"a.txt", 0, "a (1).txt"},
+	}
+	for _, c := range cases {
+		path := filepath.FromSlash(c.path)
+		var tried []string
+		got, err := NumberedName(path, func(candidate string) (bool, error) {
+			tried = append(tried, candidate)
+			return len(tried) > c.taken, nil
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", c.path, err)
+		}
+		if got != filepath.FromSlash(c.want) {
+			t.Fatalf("%s with %d taken: got %q, want %q", c.path, c.taken, got, c.want)
+		}
+	}
+
+	failure := errors.New("no access")
+	_, err := NumberedName("a.txt", func(string) (bool, error) { return false, failure })
+	if err != failure {
+		t.Fatalf("got %v, want the error from free", err)
+	}
+	_, err = NumberedName("a.txt", func(string) (bool, error) { return false, nil })
+	if err == nil || err.Error() != "no free numbered name for a.txt" {
+		t.Fatalf("every name taken: got %v", err)
+	}
+}
@@ -0,0 +1,134 @@
+package encryptor
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Disposition decides what happens to the input file once the output has been written and checked
+type Disposition int
+
+const (
+	// DispositionKeep leaves the input file where it is
+	DispositionKeep Disposition = iota
+	// DispositionTrash moves the input file to the XDG trash so it can still be restored
+	DispositionTrash
+	// DispositionDelete removes the input file
+	DispositionDelete
+	// DispositionShred overwrites the input file with random data before removing it. On SSDs and
+	// journaling or copy on write file systems old copies of the data may survive.
+	DispositionShred
+)
+
+var dispositionNames = []string{"keep", "trash", "delete", "shred"}
+
+// String returns the name used on the command line
+func (d Disposition) String() string {
+	if d < 0 || int(d) >= len(dispositionNames) {
+		return fmt.Sprintf("Disposition(%d)", int(d))
+	}
+	return dispositionNames[d]
+}
+
+// ParseDisposition parses keep, trash, delete or shred
+func ParseDisposition(name string) (Disposition, error) {
+	for i, dispositionName := range dispositionNames {
+		if name == dispositionName {
+			return Disposition(i), nil
+		}
+	}
+	return 0, errors.New("unknown disposition: " + name + ", use one of " + strings.Join(dispositionNames, ", "))
+}
+
+// Dispose applies the disposition to path
+func Dispose(path string, d Disposition) error {
+	switch d {
+	case DispositionKeep:
+		return nil
+	case DispositionTrash:
+		return MoveToTrash(path)
+	case DispositionDelete:
+		return os.Remove(path)
+	case DispositionShred:
+		return shred(path)
+	}
+	return errors.New("unknown disposition: " + d.String())
+}
+
+// DisposeError is returned by the file entry points when the output was written and checked but the
+// input could not be disposed of. The output is returned along with it, only the input is left over.
+type DisposeError struct {
+	Input string
+	Err   error
+}
+
+func (e *DisposeError) Error() string {
+	return e.Err.Error()
+}
+
+// disposeInput applies the disposition in the options to input once output is written. Unless it
+// is already known to decrypt, output is checked first so the only copy of the data is never
+// removed on the strength of an unreadable file. An output that fails the check is an error, failing
+// to dispose of the input a *DisposeError.
+func disposeInput(ctx context.Context, input, output string, opts *Options, verified bool) error {
+	if opts.Dispose == DispositionKeep {
+		return nil
+	}
+	inInfo, err := os.Stat(input)
+	if err != nil {
+		return &DisposeError{Input: input, Err: err}
+	}
+	outInfo, err := os.Stat(output)
+	if err != nil {
+		return err
+	}
+	if os.SameFile(inInfo, outInfo) {
+		return &DisposeError{Input: input, Err: errors.New("output is the same file as " + input + ", it was left in place")}
+	}
+	if !verified {
+		// the check reads the whole output again, it is not reported as progress
+		checkOpts := *opts
+		checkOpts.Progress = nil
+		_, err = VerifyContext(ctx, output, &checkOpts)
+		if err != nil {
+			return errors.New("output did not verify, " + input + " was kept: " + err.Error())
+		}
+	}
+	err = Dispose(input, opts.Dispose)
+	if err != nil {
+		return &DisposeError{Input: input, Err: errors.New("unable to " + opts.Dispose.String() + " " + input + ": " + err.Error())}
+	}
+	return nil
+}
+
+// shred overwrites every byte of path with random data and flushes it to disk before removing it
+func shred(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return errors.New("only regular files can be shredded")
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(f, rand.Reader, info.Size())
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,124 @@
+package encryptor
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// disposeFolder holds plain.txt and its encryption plain.txt.gcx
+func disposeFolder(t *testing.T) (string, string, string) {
+	dir, err := ioutil.TempDir("", "gocryptor-dispose")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	plain := filepath.Join(dir, "plain.txt")
+	err = ioutil.WriteFile(plain, testData(100000), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := EncryptFileContext(context.Background(), plain, plain+".gcx", &Options{Password: "pw", KDF: testKDF})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, plain, sealed
+}
+
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+func TestDisposeAfterEncrypt(t *testing.T) {
+	for _, d := range []Disposition{DispositionKeep, DispositionDelete, DispositionShred} {
+		dir, plain, _ := disposeFolder(t)
+		output, err := EncryptFileContext(context.Background(), plain, filepath.Join(dir, "out.gcx"), &Options{Password: "pw", KDF: testKDF, Dispose: d})
+		if err != nil {
+			t.Fatalf("%v: %v", d, err)
+		}
+		if !exists(output) {
+			t.Fatalf("%v: no output", d)
+		}
+		if exists(plain) != (d == DispositionKeep) {
+			t.Fatalf("%v: input exists %v", d, exists(plain))
+		}
+	}
+}
+
+func TestDisposeKeepsInputOfCorruptOutput(t *testing.T) {
+	for _, d := range []Disposition{DispositionTrash, DispositionDelete, DispositionShred} {
+		_, plain, sealed := disposeFolder(t)
+		data, err := ioutil.ReadFile(sealed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data[len(data)-10] ^= 1
+		err = ioutil.WriteFile(sealed, data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		original, _ := ioutil.ReadFile(plain)
+		err = disposeInput(context.Background(), plain, sealed, &Options{Password: "pw", KDF: testKDF, Dispose: d}, false)
+		if err == nil {
+			t.Fatalf("%v: a corrupt output passed the check", d)
+		}
+		if _, ok := err.(*DisposeError); ok {
+			t.Fatalf("%v: a corrupt output is a failure, not a dispose error: %v", d, err)
+		}
+		kept, err := ioutil.ReadFile(plain)
+		if err != nil || !bytes.Equal(kept, original) {
+			t.Fatalf("%v: the input was touched: %v", d, err)
+		}
+	}
+}
+
+func TestDisposeSameFile(t *testing.T) {
+	_, _, sealed := disposeFolder(t)
+	err := disposeInput(context.Background(), sealed, sealed, &Options{Password: "pw", KDF: testKDF, Dispose: DispositionDelete}, true)
+	if _, ok := err.(*DisposeError); !ok {
+		t.Fatalf("got %v, want a *DisposeError", err)
+	}
+	if !exists(sealed) {
+		t.Fatal("the output was deleted as its own input")
+	}
+}
+
+func TestShred(t *testing.T) {
+	dir, plain, _ := disposeFolder(t)
+	original, _ := ioutil.ReadFile(plain)
+	// a second link to the file shows what shredding left in its blocks
+	link := filepath.Join(dir, "link")
+	err := os.Link(plain, link)
+	if err != nil {
+		t.Skip("hard links are not supported here: " + err.Error())
+	}
+	err = Dispose(plain, DispositionShred)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists(plain) {
+		t.Fatal("the shredded file was not removed")
+	}
+	left, err := ioutil.ReadFile(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != len(original) {
+		t.Fatalf("%d bytes left, the file had %d", len(left), len(original))
+	}
+	if bytes.Equal(left, original) || bytes.Contains(left, original[:64]) {
+		t.Fatal("the file was not overwritten")
+	}
+
+	err = os.Symlink(link, plain)
+	if err != nil {
+		return
+	}
+	if Dispose(plain, DispositionShred) == nil {
+		t.Fatal("a symlink was shredded")
+	}
+}
@@ -0,0 +1,222 @@
+package encryptor
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// magic marks files written in the versioned container format, files without it are
+// treated as the original layout of nonce, salt, extension and ciphertext
+var magic = []byte("GOCRYPTR")
+
+const (
+	formatVersion = 1
+	// chunkSize is the amount of plaintext sealed under each nonce
+	chunkSize = 64 * 1024
+	// dataKeyLength is the size of the random per file AES-256 key
+	dataKeyLength = 32
+	// noncePrefixLength leaves room in the 12 byte GCM nonce for a chunk counter and final flag
+	noncePrefixLength = 7
+	// maxHeaderLength and maxChunkSize guard against allocating huge buffers for a corrupt header
+	maxHeaderLength = 1 << 20
+	maxChunkSize    = 16 << 20
+)
+
+// Payload ciphers, both take a 256 bit key and a 96 bit nonce
+const (
+	CipherAES256GCM        = "AES-256-GCM"
+	CipherChaCha20Poly1305 = "ChaCha20-Poly1305"
+)
+
+var (
+	// ErrWrongKey means no key slot could be unlocked, usually because the password is wrong
+	ErrWrongKey = errors.New("unable to unwrap data key, wrong password or key")
+	// ErrCorrupt means the data key was unlocked but the payload failed authentication
+	ErrCorrupt = errors.New("file is corrupt or has been tampered with")
+)
+
+// KeySlot stores the per file data key wrapped by one key encryption key
+type KeySlot struct {
+	// Type names the mechanism that wrapped the data key (scrypt, scrypt-hkdf, pkcs11-aes, pkcs11-rsa, vault-transit)
+	Type string `json:"type"`
+	// KeyID identifies the wrapping key, for example the label of a token key
+	KeyID string `json:"key_id,omitempty"`
+	// Salt is the KDF salt for password slots, shared by every file of a batch
+	Salt []byte `json:"salt,omitempty"`
+	// FileSalt is the per file HKDF salt for batch password slots
+	FileSalt []byte `json:"file_salt,omitempty"`
+	// KDF holds the scrypt cost for password slots, absent means DefaultKDF
+	KDF *KDFParams `json:"kdf,omitempty"`
+	// WrappedKey holds the encrypted data key
+	WrappedKey []byte `json:"wrapped_key"`
+}
+
+// header is stored in front of the payload and authenticated with every chunk
+type header struct {
+	Cipher    string            `json:"cipher"`
+	ChunkSize int               `json:"chunk_size"`
+	Nonce     []byte            `json:"nonce"`
+	Ext       string            `json:"ext"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	// ExternalAAD records that extra data not stored in the file was authenticated with each chunk
+	ExternalAAD bool `json:"external_aad,omitempty"`
+	// Attrs holds the file attributes sealed with the data key
+	Attrs    []byte    `json:"attrs,omitempty"`
+	KeySlots []KeySlot `json:"key_slots"`
+}
+
+// newHeader creates a header with a fresh nonce prefix for the given cipher and original extension
+func newHeader(random io.Reader, cipherName, fileExt string, slots ...KeySlot) (*header, error) {
+	nonce := make([]byte, noncePrefixLength)
+	_, err := io.ReadFull(random, nonce)
+	if err != nil {
+		return nil, errors.New("random data read error: " + err.Error())
+	}
+	return &header{
+		Cipher:    cipherName,
+		ChunkSize: chunkSize,
+		Nonce:     nonce,
+		Ext:       fileExt,
+		KeySlots:  slots,
+	}, nil
+}
+
+// marshal encodes the header as magic, version, length and the JSON body
+func (h *header) marshal() ([]byte, error) {
+	body, err := json.Marshal(h)
+	if err != nil {
+		return nil, errors.New("header encode error: " + err.Error())
+	}
+	buf := make([]byte, len(magic)+5, len(magic)+5+len(body))
+	copy(buf, magic)
+	buf[len(magic)] = formatVersion
+	binary.BigEndian.PutUint32(buf[len(magic)+1:], uint32(len(body)))
+	return append(buf, body...), nil
+}
+
+// isContainer reports whether the data starts with the container magic
+func isContainer(data []byte) bool {
+	return bytes.HasPrefix(data, magic)
+}
+
+// readHeader reads and decodes the header at the front of r, returning it along with the raw
+// header bytes which are authenticated with every chunk
+func readHeader(r io.Reader) (*header, []byte, error) {
+	prefix := make([]byte, len(magic)+5)
+	_, err := io.ReadFull(r, prefix)
+	if err != nil || !isContainer(prefix) {
+		return nil, nil, errors.New("not a goCryptor file")
+	}
+	if prefix[len(magic)] != formatVersion {
+		return nil, nil, errors.New("unsupported format version")
+	}
+	bodyLength := binary.BigEndian.Uint32(prefix[len(magic)+1:])
+	if bodyLength > maxHeaderLength {
+		return nil, nil, errors.New("header is truncated or corrupt")
+	}
+	rawHeader := make([]byte, len(prefix)+int(bodyLength))
+	copy(rawHeader, prefix)
+	_, err = io.ReadFull(r, rawHeader[len(prefix):])
+	if err != nil {
+		return nil, nil, errors.New("header is truncated or corrupt")
+	}
+	h := &header{}
+	err = json.Unmarshal(rawHeader[len(prefix):], h)
+	if err != nil {
+		return nil, nil, errors.New("header decode error: " + err.Error())
+	}
+	if !supportedCipher(h.Cipher) || h.ChunkSize <= 0 || h.ChunkSize > maxChunkSize || len(h.Nonce) != noncePrefixLength {
+		return nil, nil, errors.New("header has unsupported parameters")
+	}
+	return h, rawHeader, nil
+}
+
+// chunkNonce builds the nonce for chunk i, the final chunk is flagged so truncation is detected
+func chunkNonce(prefix []byte, i uint32, last bool) []byte {
+	nonce := make([]byte, nonceLength)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixLength:], i)
+	if last {
+		nonce[nonceLength-1] = 1
+	}
+	return nonce
+}
+
+// supportedCipher reports whether the payload cipher is one this version can use
+func supportedCipher(name string) bool {
+	return name == CipherAES256GCM || name == CipherChaCha20Poly1305
+}
+
+// newAEAD creates the payload cipher named in the header
+func newAEAD(cipherName string, key []byte) (cipher.AEAD, error) {
+	switch cipherName {
+	case CipherAES256GCM:
+		return newGCM(key)
+	case CipherChaCha20Poly1305:
+		aead, err := chacha20poly1305.New(key)
+		if err != nil {
+			return nil, errors.New("cipher error: " + err.Error())
+		}
+		return aead, nil
+	}
+	return nil, errors.New("unsupported cipher: " + cipherName)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.New("block error: " + err.Error())
+	}
+	aesgcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.New("cipher error: " + err.Error())
+	}
+	return aesgcm, nil
+}
+
+// newDataKey generates a random per file data key
+func newDataKey(random io.Reader) ([]byte, error) {
+	dataKey := make([]byte, dataKeyLength)
+	_, err := io.ReadFull(random, dataKey)
+	if err != nil {
+		return nil, errors.New("data key generation failed: " + err.Error())
+	}
+	return dataKey, nil
+}
+
+// sealKey encrypts a data key under a key encryption key, prefixing the random nonce
+func sealKey(random io.Reader, kek, dataKey []byte) ([]byte, error) {
+	aesgcm, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, nonceLength)
+	_, err = io.ReadFull(random, nonce)
+	if err != nil {
+		return nil, errors.New("random data read error: " + err.Error())
+	}
+	return aesgcm.Seal(nonce, nonce, dataKey, nil), nil
+}
+
+// openKey reverses sealKey, failing if the key encryption key is wrong
+func openKey(kek, wrappedKey []byte) ([]byte, error) {
+	aesgcm, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrappedKey) < nonceLength {
+		return nil, errors.New("wrapped key is truncated")
+	}
+	dataKey, err := aesgcm.Open(nil, wrappedKey[:nonceLength], wrappedKey[nonceLength:], nil)
+	if err != nil {
+		return nil, ErrWrongKey
+	}
+	return dataKey, nil
+}
@@ -0,0 +1,162 @@
+package encryptor
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// legacyVersion is reported for files written before the container format
+const legacyVersion = 0
+
+// Info describes an encrypted file as far as can be told without a password
+type Info struct {
+	// Version is the container format version, 0 for files from before the container format
+	Version   int    `json:"version"`
+	Cipher    string `json:"cipher"`
+	ChunkSize int    `json:"chunk_size,omitempty"`
+	// Ext is the original file extension
+	Ext string `json:"ext"`
+	// Metadata is the unencrypted metadata stored in the header
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// HeaderSize is the length of everything before the encrypted data, PayloadSize the length of the
+	// encrypted data and PlaintextSize what it decrypts to, worked out from the chunk layout
+	HeaderSize    int64 `json:"header_size"`
+	PayloadSize   int64 `json:"payload_size"`
+	PlaintextSize int64 `json:"plaintext_size"`
+	KeySlotCount  int   `json:"key_slot_count"`
+	// KeySlots always carry the KDF parameters of password slots, even when the file leaves out the default
+	KeySlots []KeySlot `json:"key_slots"`
+}
+
+// Inspect reads the header of an encrypted file
+func Inspect(encryptedFile string) (*Info, error) {
+	in, err := os.Open(encryptedFile)
+	if err != nil {
+		return nil, errors.New("read file err: " + err.Error())
+	}
+	defer in.Close()
+	stat, err := in.Stat()
+	if err != nil {
+		return nil, errors.New("read file err: " + err.Error())
+	}
+	br := bufio.NewReader(in)
+	prefix, _ := br.Peek(len(magic))
+	if !isContainer(prefix) {
+		// nonce, salt then a zero padded extension
+		metaData := make([]byte, 54)
+		_, err = io.ReadFull(br, metaData)
+		if err != nil || stat.Size() < legacyMinSize {
+			return nil, errors.New("not a goCryptor file")
+		}
+		fileExt := bytes.Trim(metaData[44:54], "\000")
+		kdf := DefaultKDF
+		return &Info{
+			Version:       legacyVersion,
+			Cipher:        CipherAES256GCM,
+			Ext:           string(fileExt),
+			HeaderSize:    54,
+			PayloadSize:   stat.Size() - 54,
+			PlaintextSize: stat.Size() - legacyMinSize,
+			KeySlotCount:  1,
+			// the password is stretched with scrypt at the default cost and the salt in the metadata
+			KeySlots: []KeySlot{{Type: passwordSlotType, Salt: metaData[12:44], KDF: &kdf}},
+		}, nil
+	}
+	h, rawHeader, err := readHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(h.Cipher, make([]byte, 32))
+	if err != nil {
+		return nil, err
+	}
+	payloadSize := stat.Size() - int64(len(rawHeader))
+	sealedChunk := int64(h.ChunkSize + aead.Overhead())
+	chunks := (payloadSize + sealedChunk - 1) / sealedChunk
+	slots := make([]KeySlot, len(h.KeySlots))
+	for i, slot := range h.KeySlots {
+		if slot.Type == passwordSlotType || slot.Type == batchPasswordSlotType {
+			kdf := slot.kdf()
+			slot.KDF = &kdf
+		}
+		slots[i] = slot
+	}
+	return &Info{
+		Version:       formatVersion,
+		Cipher:        h.Cipher,
+		ChunkSize:     h.ChunkSize,
+		Ext:           h.Ext,
+		Metadata:      h.Metadata,
+		HeaderSize:    int64(len(rawHeader)),
+		PayloadSize:   payloadSize,
+		PlaintextSize: payloadSize - chunks*int64(aead.Overhead()),
+		KeySlotCount:  len(slots),
+		KeySlots:      slots,
+	}, nil
+}
+
+// legacyMinSize is the smallest file in the format from before the container, the metadata and a GCM tag
+const legacyMinSize = 54 + 16
+
+// IsEncryptedFile reports whether the file looks like goCryptor output. Files in the container format
+// are recognised by their header whatever their name, files from before it have no header and are only
+// recognised by the .gcx extension.
+func IsEncryptedFile(path string) (bool, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer in.Close()
+	br := bufio.NewReader(in)
+	prefix, _ := br.Peek(len(magic))
+	if isContainer(prefix) {
+		_, _, err = readHeader(br)
+		return err == nil, nil
+	}
+	if filepath.Ext(path) != ".gcx" {
+		return false, nil
+	}
+	info, err := in.Stat()
+	if err != nil {
+		return false, err
+	}
+	return info.Size() >= legacyMinSize, nil
+}
+
+// Verify fully decrypts the file without writing anything, returning ErrWrongKey if the
+// key does not unlock it and ErrCorrupt if it fails authentication
+func Verify(wrapper KeyWrapper, encryptedFile string) error {
+	_, err := VerifyWithOptions(encryptedFile, &Options{Wrapper: wrapper})
+	return err
+}
+
+// VerifyWithOptions authenticates every chunk of the file and discards the plaintext, so memory use
+// stays at one chunk however large the file is. Files from before the container format are a single
+// sealed block and are read whole.
+func VerifyWithOptions(encryptedFile string, opts *Options) (*Result, error) {
+	return VerifyContext(context.Background(), encryptedFile, opts)
+}
+
+// VerifyContext is VerifyWithOptions that reports progress and stops when ctx is done
+func VerifyContext(ctx context.Context, encryptedFile string, opts *Options) (*Result, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	in, err := os.Open(encryptedFile)
+	if err != nil {
+		return nil, errors.New("read file err: " + err.Error())
+	}
+	defer in.Close()
+	size, err := fileSize(in)
+	if err != nil {
+		return nil, err
+	}
+	result, err := decrypt(ioutil.Discard, newProgressReader(ctx, in, opts.Progress, encryptedFile, size), opts)
+	return result, contextErr(ctx, err)
+}
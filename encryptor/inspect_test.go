@@ -0,0 +1,166 @@
+package encryptor
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// legacyFile seals data the way files were written before the container format: nonce, salt and a
+// zero padded extension, then the ciphertext under a key taken straight from the password
+func legacyFile(t *testing.T, path string, data []byte, password, ext string) {
+	nonce := testData(12)
+	salt := testData(44)[12:]
+	key, err := scrypt.Key([]byte(password), salt, DefaultKDF.N, DefaultKDF.R, DefaultKDF.P, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := make([]byte, 54)
+	copy(meta, nonce)
+	copy(meta[12:], salt)
+	copy(meta[44:], ext)
+	err = ioutil.WriteFile(path, aead.Seal(meta, nonce, data, nil), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func truncateFile(t *testing.T, path string, size int64) {
+	err := os.Truncate(path, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClassifyFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gocryptor-inspect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := testData(3*chunkSize + 100)
+	plain := filepath.Join(dir, "plain.txt")
+	err = ioutil.WriteFile(plain, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1 := filepath.Join(dir, "v1.gcx")
+	_, err = EncryptFileContext(context.Background(), plain, v1, &Options{Password: "pw", KDF: testKDF})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := Inspect(v1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copyFile := func(from, name string) string {
+		contents, err := ioutil.ReadFile(from)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, name)
+		err = ioutil.WriteFile(path, contents, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	// a container is recognised whatever it is called
+	renamed := copyFile(v1, "v1.bin")
+	cutHeader := copyFile(v1, "cut header.gcx")
+	truncateFile(t, cutHeader, info.HeaderSize-3)
+	cutPayload := copyFile(v1, "cut payload.gcx")
+	truncateFile(t, cutPayload, info.HeaderSize+info.PayloadSize/2)
+	// dropping the whole final chunk leaves a file that ends on a chunk boundary without its last chunk
+	cutChunk := copyFile(v1, "cut chunk.gcx")
+	truncateFile(t, cutChunk, info.HeaderSize+3*int64(chunkSize+16))
+
+	legacy := filepath.Join(dir, "legacy.gcx")
+	legacyFile(t, legacy, data[:1000], "pw", ".txt")
+	legacyRenamed := copyFile(legacy, "legacy.bin")
+	legacyCut := copyFile(legacy, "legacy cut.gcx")
+	truncateFile(t, legacyCut, 500)
+	legacyStub := copyFile(legacy, "legacy stub.gcx")
+	truncateFile(t, legacyStub, legacyMinSize-1)
+
+	cases := []struct {
+		name      string
+		path      string
+		encrypted bool
+		// version is what Inspect reports, -1 for an error
+		version int
+		// right and wrong are what verifying with the right and a wrong password return, anyError
+		// only expects some error from both
+		right, wrong error
+		anyError     bool
+	}{
+		{"v1", v1, true, formatVersion, nil, ErrWrongKey, false},
+		{"v1 renamed", renamed, true, formatVersion, nil, ErrWrongKey, false},
+		{"v1 header cut short", cutHeader, false, -1, nil, nil, true},
+		{"v1 payload cut short", cutPayload, true, formatVersion, ErrCorrupt, ErrWrongKey, false},
+		{"v1 final chunk missing", cutChunk, true, formatVersion, ErrCorrupt, ErrWrongKey, false},
+		// files from before the container cannot tell a wrong password from damage
+		{"legacy", legacy, true, legacyVersion, nil, ErrWrongKey, false},
+		{"legacy cut short", legacyCut, true, legacyVersion, ErrWrongKey, ErrWrongKey, false},
+		{"legacy stub", legacyStub, false, -1, nil, nil, true},
+		// without a header Inspect cannot tell a plain file from the old format, IsEncryptedFile
+		// goes by the name as well
+		{"plain", plain, false, legacyVersion, ErrWrongKey, ErrWrongKey, false},
+	}
+	for _, c := range cases {
+		encrypted, err := IsEncryptedFile(c.path)
+		if err != nil || encrypted != c.encrypted {
+			t.Fatalf("%s: IsEncryptedFile %v, %v, want %v", c.name, encrypted, err, c.encrypted)
+		}
+		info, err := Inspect(c.path)
+		if c.version < 0 {
+			if err == nil {
+				t.Fatalf("%s: Inspect accepted it as version %d", c.name, info.Version)
+			}
+		} else if err != nil || info.Version != c.version {
+			t.Fatalf("%s: Inspect %+v, %v, want version %d", c.name, info, err, c.version)
+		}
+		for _, password := range []string{"pw", "wrong"} {
+			want := c.right
+			if password == "wrong" {
+				want = c.wrong
+			}
+			_, err := VerifyWithOptions(c.path, &Options{Password: password})
+			if c.anyError {
+				if err == nil {
+					t.Fatalf("%s: verified with %q", c.name, password)
+				}
+			} else if err != want {
+				t.Fatalf("%s: verify with %q returned %v, want %v", c.name, password, err, want)
+			}
+		}
+	}
+
+	// a legacy file is only recognised by its extension
+	encrypted, err := IsEncryptedFile(legacyRenamed)
+	if err != nil || encrypted {
+		t.Fatalf("legacy renamed: IsEncryptedFile %v, %v", encrypted, err)
+	}
+	info, err = Inspect(legacy)
+	if err != nil || info.Ext != ".txt" || info.PlaintextSize != 1000 {
+		t.Fatalf("legacy: Inspect %+v, %v", info, err)
+	}
+	info, err = Inspect(v1)
+	if err != nil || info.Ext != ".txt" || info.PlaintextSize != int64(len(data)) || info.KeySlotCount != 1 {
+		t.Fatalf("v1: Inspect %+v, %v", info, err)
+	}
+}
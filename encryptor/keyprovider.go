@@ -0,0 +1,164 @@
+package encryptor
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// KeyProvider supplies the password for an operation, confirm asks interactive providers to
+// have the user enter it twice (used when encrypting)
+type KeyProvider interface {
+	Password(confirm bool) (string, error)
+}
+
+// PromptKeyProvider asks for the password on the terminal without echoing it
+type PromptKeyProvider struct {
+	// Prompt is printed to stderr before reading, defaults to "Password: "
+	Prompt string
+}
+
+// Password reads from stdin if it is a terminal, otherwise from the controlling terminal so stdin can carry data
+func (p *PromptKeyProvider) Password(confirm bool) (string, error) {
+	in := os.Stdin
+	if !terminal.IsTerminal(int(in.Fd())) {
+		tty, err := os.Open("/dev/tty")
+		if err != nil {
+			return "", errors.New("no terminal available to prompt for a password")
+		}
+		defer tty.Close()
+		in = tty
+	}
+	prompt := p.Prompt
+	if prompt == "" {
+		prompt = "Password: "
+	}
+	password, err := readTerminalPassword(in, prompt)
+	if err != nil {
+		return "", err
+	}
+	if password == "" {
+		return "", errors.New("password cannot be empty")
+	}
+	if !confirm {
+		return password, nil
+	}
+	confirmation, err := readTerminalPassword(in, "Confirm "+strings.ToLower(prompt[:1])+prompt[1:])
+	if err != nil {
+		return "", err
+	}
+	if password != confirmation {
+		return "", errors.New("passwords do not match")
+	}
+	return password, nil
+}
+
+func readTerminalPassword(in *os.File, prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	password, err := terminal.ReadPassword(int(in.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", errors.New("unable to read password: " + err.Error())
+	}
+	return string(password), nil
+}
+
+// EnvKeyProvider reads the password from an environment variable
+type EnvKeyProvider struct {
+	Name string
+}
+
+// Password returns the variable's value, an unset or empty variable is an error
+func (p *EnvKeyProvider) Password(confirm bool) (string, error) {
+	password := os.Getenv(p.Name)
+	if password == "" {
+		return "", errors.New("environment variable " + p.Name + " is not set")
+	}
+	return password, nil
+}
+
+// FileKeyProvider reads the password from the first line of a file
+type FileKeyProvider struct {
+	Path string
+}
+
+// Password reads the file each time it is called
+func (p *FileKeyProvider) Password(confirm bool) (string, error) {
+	contents, err := ioutil.ReadFile(p.Path)
+	if err != nil {
+		return "", errors.New("unable to read password file: " + err.Error())
+	}
+	return firstLine(contents, "password file")
+}
+
+// FDKeyProvider reads the password from an inherited file descriptor, for example `--password-fd 3 3<secret`
+type FDKeyProvider struct {
+	FD       uintptr
+	password string
+}
+
+// Password reads the descriptor once and reuses the result on later calls
+func (p *FDKeyProvider) Password(confirm bool) (string, error) {
+	if p.password != "" {
+		return p.password, nil
+	}
+	f := os.NewFile(p.FD, "password-fd")
+	if f == nil {
+		return "", fmt.Errorf("invalid password file descriptor: %d", p.FD)
+	}
+	defer f.Close()
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil && len(line) == 0 {
+		return "", errors.New("unable to read password file descriptor: " + err.Error())
+	}
+	p.password, err = firstLine(line, "password file descriptor")
+	return p.password, err
+}
+
+// CommandKeyProvider runs an external command, such as `pass show backup`, and uses the first line it prints
+type CommandKeyProvider struct {
+	Command string
+}
+
+// Password runs the command through the shell, its stderr is passed through so it can prompt the user.
+// It reads from the terminal rather than stdin, which may be carrying the data being encrypted
+func (p *CommandKeyProvider) Password(confirm bool) (string, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", p.Command)
+	} else {
+		cmd = exec.Command("sh", "-c", p.Command)
+	}
+	if terminal.IsTerminal(int(os.Stdin.Fd())) {
+		cmd.Stdin = os.Stdin
+	} else if tty, err := os.Open("/dev/tty"); err == nil {
+		defer tty.Close()
+		cmd.Stdin = tty
+	}
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", errors.New("password command failed: " + err.Error())
+	}
+	return firstLine(out, "password command output")
+}
+
+// firstLine returns the data up to the first newline, erroring if that is empty
+func firstLine(data []byte, source string) (string, error) {
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		data = data[:i]
+	}
+	password := strings.TrimSuffix(string(data), "\r")
+	if password == "" {
+		return "", errors.New(source + " is empty")
+	}
+	return password, nil
+}
@@ -0,0 +1,41 @@
+package encryptor
+
+import (
+	"io/ioutil"
+	"os"
+	"runtime"
+	"testing"
+)
+
+func TestCommandKeyProviderLeavesStdin(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the command runs through sh")
+	}
+	if tty, err := os.Open("/dev/tty"); err == nil {
+		tty.Close()
+		t.Skip("the command would read from the terminal")
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	stdin := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = stdin }()
+	w.Write([]byte("data being encrypted\n"))
+	w.Close()
+
+	// a command that reads stdin would print the data instead of its password
+	password, err := (&CommandKeyProvider{Command: "cat; echo secret"}).Password(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if password != "secret" {
+		t.Fatalf("got %q, the command read stdin", password)
+	}
+	rest, _ := ioutil.ReadAll(r)
+	if string(rest) != "data being encrypted\n" {
+		t.Fatalf("stdin was consumed, %q left", rest)
+	}
+}
@@ -0,0 +1,392 @@
+package encryptor
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Options controls how data is encrypted and decrypted, every entry point takes them and the
+// zero value of each field picks the default
+type Options struct {
+	// Wrapper protects the data key, when it is nil a password wrapper is built from Password and KDF
+	Wrapper KeyWrapper
+	// Password is used when there is no Wrapper
+	Password string
+	// KDF is the scrypt cost for password slots written with Password, DefaultKDF when zero. Decryption
+	// uses the cost recorded in the file.
+	KDF KDFParams
+	// Cipher is the payload cipher, CipherAES256GCM when empty. Decryption uses the cipher recorded in the file.
+	Cipher string
+	// Ext is the original file extension recorded in the header
+	Ext string
+	// Metadata is stored in the header, it is authenticated but not encrypted so it must not hold secrets
+	Metadata map[string]string
+	// AAD is authenticated with every chunk but not stored, decryption must be given the same bytes
+	AAD []byte
+	// Rand is the source of data keys, nonces and password salts, crypto/rand when nil
+	Rand io.Reader
+	// Conflict decides what the file entry points do when the output exists, ConflictOverwrite by default
+	Conflict ConflictPolicy
+	// Ask chooses the policy for an existing output when Conflict is ConflictAsk
+	Ask func(path string) ConflictPolicy
+	// Attrs are stored, encrypted, in the header. The file entry points read them from the input file
+	// and restore them on decrypt.
+	Attrs *FileAttrs
+	// NoAttrs stops the file entry points storing or restoring attributes
+	NoAttrs bool
+	// Xattrs and Ownership make the file entry points keep extended attributes and the owner as well
+	// as the mode and times
+	Xattrs    bool
+	Ownership bool
+	// Concurrency is how many chunks of a stream are sealed or opened at once, GOMAXPROCS when 0.
+	// The output is the same whatever it is set to.
+	Concurrency int
+	// Progress, if set, is called as the input is read. The Context entry points stop with the
+	// context's error once it is done, and the file ones remove what they had written.
+	Progress func(Progress)
+	// Dispose is what the file entry points do with the input once the output is written, an
+	// encrypted output is fully decrypted first to check it. DispositionKeep by default. If the input
+	// cannot be disposed of the output is still returned, with a *DisposeError.
+	Dispose Disposition
+}
+
+// Result describes what was recorded alongside decrypted data
+type Result struct {
+	// Ext is the original file extension
+	Ext      string
+	Metadata map[string]string
+	// Output is the file written by the file entry points, after any conflict was resolved
+	Output string
+	// Attrs are the stored file attributes, nil if there are none
+	Attrs *FileAttrs
+}
+
+// random returns the randomness source for the options
+func (opts *Options) random() io.Reader {
+	if opts.Rand == nil {
+		return rand.Reader
+	}
+	return opts.Rand
+}
+
+// wrapper returns the key wrapper for the options, building a password wrapper if needed
+func (opts *Options) wrapper() (KeyWrapper, error) {
+	if opts.Wrapper != nil {
+		return opts.Wrapper, nil
+	}
+	if opts.Password == "" {
+		return nil, errors.New("no key given, set a Wrapper or Password")
+	}
+	kdf := opts.KDF
+	if kdf == (KDFParams{}) {
+		kdf = DefaultKDF
+	}
+	err := kdf.validate()
+	if err != nil {
+		return nil, err
+	}
+	return newPasswordWrapper(opts.Password, nil, kdf, opts.random()), nil
+}
+
+// EncryptWithOptions reads plaintext from r until EOF and writes it to w encrypted under a fresh data key
+func EncryptWithOptions(w io.Writer, r io.Reader, opts *Options) error {
+	return EncryptContext(context.Background(), w, r, opts)
+}
+
+// EncryptContext is EncryptWithOptions that reports progress and stops when ctx is done
+func EncryptContext(ctx context.Context, w io.Writer, r io.Reader, opts *Options) error {
+	if opts == nil {
+		opts = &Options{}
+	}
+	return contextErr(ctx, encrypt(w, newProgressReader(ctx, r, opts.Progress, "", 0), opts))
+}
+
+func encrypt(w io.Writer, r io.Reader, opts *Options) error {
+	cipherName := opts.Cipher
+	if cipherName == "" {
+		cipherName = CipherAES256GCM
+	}
+	if !supportedCipher(cipherName) {
+		return errors.New("unsupported cipher: " + cipherName)
+	}
+	wrapper, err := opts.wrapper()
+	if err != nil {
+		return err
+	}
+	dataKey, slot, err := newWrappedDataKey(wrapper, opts.random())
+	if err != nil {
+		return err
+	}
+	h, err := newHeader(opts.random(), cipherName, opts.Ext, slot)
+	if err != nil {
+		return err
+	}
+	h.Metadata = opts.Metadata
+	h.ExternalAAD = len(opts.AAD) > 0
+	if opts.Attrs != nil {
+		h.Attrs, err = sealAttrs(h, dataKey, opts.Attrs)
+		if err != nil {
+			return err
+		}
+	}
+	return encryptStream(w, r, h, dataKey, opts.AAD, opts.Concurrency)
+}
+
+// DecryptWithOptions reads encrypted data from r and writes the plaintext to w. Each chunk is written
+// once it has been authenticated, so if an error is returned w may hold part of the plaintext and
+// should be discarded.
+func DecryptWithOptions(w io.Writer, r io.Reader, opts *Options) (*Result, error) {
+	return DecryptContext(context.Background(), w, r, opts)
+}
+
+// DecryptContext is DecryptWithOptions that reports progress and stops when ctx is done
+func DecryptContext(ctx context.Context, w io.Writer, r io.Reader, opts *Options) (*Result, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	result, err := decrypt(w, newProgressReader(ctx, r, opts.Progress, "", 0), opts)
+	return result, contextErr(ctx, err)
+}
+
+func decrypt(w io.Writer, r io.Reader, opts *Options) (*Result, error) {
+	wrapper, err := opts.wrapper()
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(r)
+	prefix, _ := br.Peek(len(magic))
+	if !isContainer(prefix) {
+		if len(opts.AAD) > 0 {
+			return nil, errors.New("files from before the container format cannot authenticate AAD")
+		}
+		return decryptLegacyStream(w, br, wrapper)
+	}
+	h, rawHeader, err := readHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	if h.ExternalAAD && len(opts.AAD) == 0 {
+		return nil, errors.New("file was encrypted with additional authenticated data, it must be given to decrypt")
+	}
+	dataKey, err := unwrapDataKey(wrapper, h)
+	if err != nil {
+		return nil, err
+	}
+	attrs, err := openAttrs(h, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	err = decryptStream(w, br, h, rawHeader, dataKey, opts.AAD, opts.Concurrency)
+	if err != nil {
+		return nil, err
+	}
+	return &Result{Ext: h.Ext, Metadata: h.Metadata, Attrs: attrs}, nil
+}
+
+// EncryptBytes encrypts a blob in memory
+func EncryptBytes(plaintext []byte, opts *Options) ([]byte, error) {
+	var out bytes.Buffer
+	err := EncryptWithOptions(&out, bytes.NewReader(plaintext), opts)
+	if err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// DecryptBytes decrypts a blob in memory, nothing is returned unless the whole blob authenticates
+func DecryptBytes(data []byte, opts *Options) ([]byte, *Result, error) {
+	var out bytes.Buffer
+	result, err := DecryptWithOptions(&out, bytes.NewReader(data), opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	return out.Bytes(), result, nil
+}
+
+// EncryptFileWithOptions encrypts inputFile to outputFile, applying the conflict policy if it exists,
+// and returns the path written. The extension of inputFile is recorded unless opts sets one.
+func EncryptFileWithOptions(inputFile, outputFile string, opts *Options) (string, error) {
+	return EncryptFileContext(context.Background(), inputFile, outputFile, opts)
+}
+
+// EncryptFileContext is EncryptFileWithOptions that reports progress and stops when ctx is done,
+// leaving no output behind
+func EncryptFileContext(ctx context.Context, inputFile, outputFile string, opts *Options) (string, error) {
+	fileOpts := Options{}
+	if opts != nil {
+		fileOpts = *opts
+	}
+	if fileOpts.Ext == "" {
+		// the original extension is stored in the header for decryption
+		fileOpts.Ext = filepath.Ext(inputFile)
+	}
+	if fileOpts.NoAttrs {
+		fileOpts.Attrs = nil
+	} else if fileOpts.Attrs == nil {
+		var err error
+		fileOpts.Attrs, err = ReadFileAttrs(inputFile, fileOpts.Xattrs, fileOpts.Ownership)
+		if err != nil {
+			return "", err
+		}
+	}
+	if fileOpts.Dispose != DispositionKeep && fileOpts.Wrapper == nil {
+		// one wrapper encrypts and verifies so the password is only stretched once
+		var err error
+		fileOpts.Wrapper, err = fileOpts.wrapper()
+		if err != nil {
+			return "", err
+		}
+	}
+	in, err := os.Open(inputFile)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	size, err := fileSize(in)
+	if err != nil {
+		return "", err
+	}
+	out, err := CreateOutput(outputFile, 0644, fileOpts.Conflict, fileOpts.Ask)
+	if err != nil {
+		return "", outputErr("Error writing file: ", err)
+	}
+	outputFile = out.Target()
+	err = encrypt(out, newProgressReader(ctx, in, fileOpts.Progress, inputFile, size), &fileOpts)
+	if err != nil {
+		out.Abort()
+		return "", contextErr(ctx, err)
+	}
+	err = out.Commit()
+	if err != nil {
+		return "", errors.New("Error writing file: " + err.Error())
+	}
+	in.Close()
+	return outputFile, disposeInput(ctx, inputFile, outputFile, &fileOpts, false)
+}
+
+// DecryptFileWithOptions decrypts encryptedFile to outputFile, applying the conflict policy if it
+// exists. The whole file is authenticated before outputFile is touched.
+func DecryptFileWithOptions(encryptedFile, outputFile string, opts *Options) (*Result, error) {
+	return DecryptFileContext(context.Background(), encryptedFile, outputFile, opts)
+}
+
+// DecryptFileContext is DecryptFileWithOptions that reports progress and stops when ctx is done,
+// leaving no output behind
+func DecryptFileContext(ctx context.Context, encryptedFile, outputFile string, opts *Options) (*Result, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	return decryptFileAtomic(ctx, encryptedFile, outputFile, opts)
+}
+
+// DecryptFileToDir decrypts into dir, naming the output after the encrypted file with its original
+// extension and applying the conflict policy if that exists
+func DecryptFileToDir(encryptedFile, dir string, opts *Options) (*Result, error) {
+	return DecryptFileToDirContext(context.Background(), encryptedFile, dir, opts)
+}
+
+// DecryptFileToDirContext is DecryptFileToDir that reports progress and stops when ctx is done,
+// leaving no output behind
+func DecryptFileToDirContext(ctx context.Context, encryptedFile, dir string, opts *Options) (*Result, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	// the original extension is in the header so the name is known before decrypting
+	info, err := Inspect(encryptedFile)
+	if err != nil {
+		return nil, err
+	}
+	return decryptFileAtomic(ctx, encryptedFile, DecryptedName(dir, encryptedFile, info.Ext), opts)
+}
+
+// decryptFileAtomic decrypts into a temporary file that only replaces outputFile once every chunk has
+// authenticated, so a bad file never replaces a good one. An outputFile that is encryptedFile itself
+// gets a numbered name whatever the conflict policy.
+func decryptFileAtomic(ctx context.Context, encryptedFile, outputFile string, opts *Options) (*Result, error) {
+	in, err := os.Open(encryptedFile)
+	if err != nil {
+		return nil, errors.New("read file err: " + err.Error())
+	}
+	defer in.Close()
+	size, err := fileSize(in)
+	if err != nil {
+		return nil, err
+	}
+	policy := opts.Conflict
+	if SameFile(encryptedFile, outputFile) {
+		// a renamed file can be named for its own plaintext, it gets a numbered name rather than
+		// being replaced by it
+		policy = ConflictNumber
+	}
+	// without a stored mode the plaintext is only readable by the user
+	out, err := CreateOutput(outputFile, 0600, policy, opts.Ask)
+	if err != nil {
+		return nil, outputErr("Error writing plaintext file: ", err)
+	}
+	outputFile = out.Target()
+	buffered := bufio.NewWriter(out)
+	result, err := decrypt(buffered, newProgressReader(ctx, in, opts.Progress, encryptedFile, size), opts)
+	err = contextErr(ctx, err)
+	if err == nil {
+		err = buffered.Flush()
+	}
+	restore := err == nil && result.Attrs != nil && !opts.NoAttrs
+	if restore {
+		applyAttrs(out, result.Attrs, opts.Xattrs, opts.Ownership)
+	}
+	if err != nil {
+		out.Abort()
+		return nil, err
+	}
+	err = out.Commit()
+	if err != nil {
+		return nil, errors.New("Error writing plaintext file: " + err.Error())
+	}
+	if restore {
+		err = applyTimes(outputFile, result.Attrs)
+		if err != nil {
+			return nil, err
+		}
+	}
+	result.Output = outputFile
+	in.Close()
+	// every chunk authenticated on the way to outputFile, so it needs no second check
+	return result, disposeInput(ctx, encryptedFile, outputFile, opts, true)
+}
+
+// SameFile reports whether a and b both exist and are the same file, however they are named
+func SameFile(a, b string) bool {
+	aInfo, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bInfo, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(aInfo, bInfo)
+}
+
+// outputErr describes a failure to create an output file, the conflict errors are passed on as they
+// are so callers can compare them
+func outputErr(prefix string, err error) error {
+	if err == ErrSkipped || err == ErrExists {
+		return err
+	}
+	return errors.New(prefix + err.Error())
+}
+
+// fileSize returns the size of an open file for progress reports
+func fileSize(f *os.File) (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, errors.New("read file err: " + err.Error())
+	}
+	return info.Size(), nil
+}
@@ -0,0 +1,246 @@
+package encryptor
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// PinentryKeyProvider asks for the password through a pinentry program using the Assuan protocol,
+// so any of pinentry-gnome3, pinentry-qt, pinentry-curses or pinentry-tty can be used
+type PinentryKeyProvider struct {
+	// Program is the pinentry binary to run, defaults to pinentry from the PATH
+	Program string
+	// Title, Description and Prompt are shown in the pinentry dialog
+	Title       string
+	Description string
+	Prompt      string
+}
+
+// pinentryConn is one running pinentry process we talk Assuan to over its stdin and stdout
+type pinentryConn struct {
+	cmd *exec.Cmd
+	in  io.WriteCloser
+	out *bufio.Reader
+}
+
+// Password asks for the password with GETPIN, when confirming it asks a second time and compares
+func (p *PinentryKeyProvider) Password(confirm bool) (string, error) {
+	conn, err := p.open()
+	if err != nil {
+		return "", err
+	}
+	defer conn.close()
+	password, err := conn.getPin()
+	if err != nil {
+		return "", err
+	}
+	if password == "" {
+		return "", errors.New("password cannot be empty")
+	}
+	if !confirm {
+		return password, nil
+	}
+	err = conn.command("SETDESC", "Please enter the password again to confirm it")
+	if err != nil {
+		return "", err
+	}
+	confirmation, err := conn.getPin()
+	if err != nil {
+		return "", err
+	}
+	if password != confirmation {
+		return "", errors.New("passwords do not match")
+	}
+	return password, nil
+}
+
+// Confirm shows the description with OK and Cancel buttons, returning true if the user chose OK
+func (p *PinentryKeyProvider) Confirm(description string) (bool, error) {
+	conn, err := p.open()
+	if err != nil {
+		return false, err
+	}
+	defer conn.close()
+	err = conn.command("SETDESC", description)
+	if err != nil {
+		return false, err
+	}
+	_, err = conn.request("CONFIRM")
+	if err == errPinentryCancelled {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// open starts the pinentry, reads its greeting and sends the dialog text and terminal options
+func (p *PinentryKeyProvider) open() (*pinentryConn, error) {
+	program := p.Program
+	if program == "" {
+		program = "pinentry"
+	}
+	cmd := exec.Command(program)
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, errors.New("unable to start pinentry: " + err.Error())
+	}
+	conn := &pinentryConn{cmd: cmd, in: in, out: bufio.NewReader(out)}
+	// the server greets us with OK before accepting commands
+	_, err = conn.readResponse()
+	if err != nil {
+		conn.close()
+		return nil, err
+	}
+	// curses based pinentries need to know which terminal to draw on
+	if tty := os.Getenv("GPG_TTY"); tty != "" {
+		err = conn.command("OPTION", "ttyname="+tty)
+		if err != nil {
+			conn.close()
+			return nil, err
+		}
+	}
+	prompt := p.Prompt
+	if prompt == "" {
+		prompt = "Password:"
+	}
+	settings := [][2]string{{"SETTITLE", p.Title}, {"SETDESC", p.Description}, {"SETPROMPT", prompt}}
+	for _, setting := range settings {
+		if setting[1] == "" {
+			continue
+		}
+		err = conn.command(setting[0], setting[1])
+		if err != nil {
+			conn.close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (c *pinentryConn) getPin() (string, error) {
+	data, err := c.request("GETPIN")
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// command sends a command with an escaped argument and waits for OK
+func (c *pinentryConn) command(name, arg string) error {
+	_, err := c.request(name + " " + assuanEscape(arg))
+	return err
+}
+
+// request sends one line and collects any data lines until OK or ERR
+func (c *pinentryConn) request(line string) ([]byte, error) {
+	_, err := io.WriteString(c.in, line+"\n")
+	if err != nil {
+		return nil, errors.New("pinentry write error: " + err.Error())
+	}
+	return c.readResponse()
+}
+
+func (c *pinentryConn) readResponse() ([]byte, error) {
+	var data []byte
+	for {
+		line, err := c.out.ReadString('\n')
+		if err != nil {
+			return nil, errors.New("pinentry closed the connection")
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case line == "OK" || strings.HasPrefix(line, "OK "):
+			return data, nil
+		case strings.HasPrefix(line, "D "):
+			decoded, err := url.PathUnescape(line[2:])
+			if err != nil {
+				return nil, errors.New("pinentry sent malformed data")
+			}
+			data = append(data, decoded...)
+		case strings.HasPrefix(line, "ERR "):
+			return nil, pinentryError(line[4:])
+		}
+		// status (S) and comment (#) lines are ignored
+	}
+}
+
+func (c *pinentryConn) close() {
+	io.WriteString(c.in, "BYE\n")
+	c.in.Close()
+	c.cmd.Wait()
+}
+
+// errPinentryCancelled is returned when the user closes or cancels the dialog
+var errPinentryCancelled = errors.New("password entry was cancelled")
+
+// pinentryError maps an Assuan ERR line to an error, code 83886179 is GPG_ERR_CANCELED
+func pinentryError(errLine string) error {
+	code := strings.SplitN(errLine, " ", 2)[0]
+	if code == "83886179" || code == "83886194" {
+		return errPinentryCancelled
+	}
+	return errors.New("pinentry error: " + errLine)
+}
+
+// assuanEscape percent encodes the characters Assuan does not allow in a command line
+func assuanEscape(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
+// AskpassKeyProvider runs an SSH_ASKPASS style helper, which is given the prompt as its only
+// argument and prints the password on stdout
+type AskpassKeyProvider struct {
+	// Program is the helper to run, defaults to $SSH_ASKPASS
+	Program string
+	Prompt  string
+}
+
+// Password runs the helper, and runs it again with a confirmation prompt when confirming
+func (p *AskpassKeyProvider) Password(confirm bool) (string, error) {
+	prompt := p.Prompt
+	if prompt == "" {
+		prompt = "goCryptor password: "
+	}
+	password, err := p.ask(prompt)
+	if err != nil || !confirm {
+		return password, err
+	}
+	confirmation, err := p.ask("Confirm " + prompt)
+	if err != nil {
+		return "", err
+	}
+	if password != confirmation {
+		return "", errors.New("passwords do not match")
+	}
+	return password, nil
+}
+
+func (p *AskpassKeyProvider) ask(prompt string) (string, error) {
+	program := p.Program
+	if program == "" {
+		program = os.Getenv("SSH_ASKPASS")
+	}
+	if program == "" {
+		return "", errors.New("no askpass program configured and SSH_ASKPASS is not set")
+	}
+	out, err := exec.Command(program, prompt).Output()
+	if err != nil {
+		return "", errors.New("askpass program failed: " + err.Error())
+	}
+	return firstLine(out, "askpass output")
+}
@@ -0,0 +1,218 @@
+package encryptor
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The test binary doubles as a fake pinentry: when GOCRYPTOR_FAKE_PINENTRY is set it speaks
+// Assuan on stdin and stdout instead of running the tests
+func TestMain(m *testing.M) {
+	if os.Getenv("GOCRYPTOR_FAKE_PINENTRY") != "" {
+		fakePinentry()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// fakeScript tells the fake pinentry how to answer
+type fakeScript struct {
+	// Pins are the answers to successive GETPINs, "cancel" answers with GPG_ERR_CANCELED
+	Pins []string
+	// Confirm answers CONFIRM with "ok", "cancel" or "fail"
+	Confirm string
+	// Log is where every command received is written
+	Log string
+}
+
+func fakePinentry() {
+	var script fakeScript
+	err := json.Unmarshal([]byte(os.Getenv("GOCRYPTOR_FAKE_PINENTRY")), &script)
+	if err != nil {
+		os.Exit(2)
+	}
+	log, err := os.Create(script.Log)
+	if err != nil {
+		os.Exit(2)
+	}
+	defer log.Close()
+	in := bufio.NewScanner(os.Stdin)
+	out := bufio.NewWriter(os.Stdout)
+	reply := func(lines ...string) {
+		for _, line := range lines {
+			fmt.Fprint(out, line+"\n")
+		}
+		out.Flush()
+	}
+	reply("# fake pinentry", "OK Pleased to meet you")
+	for in.Scan() {
+		line := in.Text()
+		fmt.Fprintln(log, line)
+		switch strings.SplitN(line, " ", 2)[0] {
+		case "GETPIN":
+			if len(script.Pins) == 0 {
+				reply("ERR 83886360 no more pins")
+				continue
+			}
+			pin := script.Pins[0]
+			script.Pins = script.Pins[1:]
+			if pin == "cancel" {
+				reply("ERR 83886179 Operation cancelled <Pinentry>")
+				continue
+			}
+			// split the escaped pin over two data lines with a status line between them
+			escaped := assuanEscape(pin)
+			half := len(escaped) / 2
+			if i := strings.LastIndex(escaped[:half], "%"); i >= 0 && i > half-3 {
+				half = i
+			}
+			reply("D "+escaped[:half], "S PASSPHRASE_QUALITY 50", "D "+escaped[half:], "OK")
+		case "CONFIRM":
+			switch script.Confirm {
+			case "ok":
+				reply("OK")
+			case "cancel":
+				reply("ERR 83886194 Not confirmed <Pinentry>")
+			default:
+				reply("ERR 83886360 no display <Pinentry>")
+			}
+		case "BYE":
+			reply("OK closing connection")
+			return
+		default:
+			reply("OK")
+		}
+	}
+}
+
+// fakePinentryProvider points a PinentryKeyProvider at the test binary running the script,
+// returning the path of the command log
+func fakePinentryProvider(t *testing.T, script fakeScript) (*PinentryKeyProvider, string) {
+	dir, err := ioutil.TempDir("", "gocryptor-pinentry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	script.Log = filepath.Join(dir, "commands")
+	encoded, err := json.Marshal(script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("GOCRYPTOR_FAKE_PINENTRY", string(encoded))
+	t.Cleanup(func() { os.Unsetenv("GOCRYPTOR_FAKE_PINENTRY") })
+	os.Unsetenv("GPG_TTY")
+	program, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &PinentryKeyProvider{Program: program, Title: "goCryptor", Description: "Unlock notes.txt\n100% private"}, script.Log
+}
+
+func readCommands(t *testing.T, log string) []string {
+	data, err := ioutil.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func TestPinentryGetPin(t *testing.T) {
+	for _, pin := range []string{"secret", "ab", "100% sure\nnext line\r", "%41 is not A", "ünïcode pässword"} {
+		p, log := fakePinentryProvider(t, fakeScript{Pins: []string{pin}})
+		password, err := p.Password(false)
+		if err != nil {
+			t.Fatalf("%q: %v", pin, err)
+		}
+		if password != pin {
+			t.Fatalf("got %q, want %q", password, pin)
+		}
+		want := []string{
+			"SETTITLE goCryptor",
+			"SETDESC Unlock notes.txt%0A100%25 private",
+			"SETPROMPT Password:",
+			"GETPIN",
+			"BYE",
+		}
+		if got := readCommands(t, log); strings.Join(got, "|") != strings.Join(want, "|") {
+			t.Fatalf("pinentry was sent %q, want %q", got, want)
+		}
+	}
+}
+
+func TestPinentryCancel(t *testing.T) {
+	p, _ := fakePinentryProvider(t, fakeScript{Pins: []string{"cancel"}})
+	_, err := p.Password(false)
+	if err != errPinentryCancelled {
+		t.Fatalf("got %v, want errPinentryCancelled", err)
+	}
+	// cancelling the confirmation cancels the whole entry
+	p, _ = fakePinentryProvider(t, fakeScript{Pins: []string{"secret", "cancel"}})
+	_, err = p.Password(true)
+	if err != errPinentryCancelled {
+		t.Fatalf("confirming: got %v, want errPinentryCancelled", err)
+	}
+}
+
+func TestPinentryPasswordConfirm(t *testing.T) {
+	p, log := fakePinentryProvider(t, fakeScript{Pins: []string{"secret", "secret"}})
+	password, err := p.Password(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if password != "secret" {
+		t.Fatalf("got %q", password)
+	}
+	got := readCommands(t, log)
+	if len(got) < 3 || got[len(got)-3] != "SETDESC Please enter the password again to confirm it" || got[len(got)-2] != "GETPIN" {
+		t.Fatalf("pinentry was not asked to confirm, commands were %q", got)
+	}
+
+	p, _ = fakePinentryProvider(t, fakeScript{Pins: []string{"secret", "secrte"}})
+	_, err = p.Password(true)
+	if err == nil || err.Error() != "passwords do not match" {
+		t.Fatalf("mismatch: got %v", err)
+	}
+
+	p, _ = fakePinentryProvider(t, fakeScript{Pins: []string{""}})
+	_, err = p.Password(false)
+	if err == nil || err.Error() != "password cannot be empty" {
+		t.Fatalf("empty: got %v", err)
+	}
+}
+
+func TestPinentryConfirm(t *testing.T) {
+	cases := []struct {
+		answer string
+		ok     bool
+		err    string
+	}{
+		{"ok", true, ""},
+		{"cancel", false, ""},
+		{"fail", false, "pinentry error: 83886360 no display <Pinentry>"},
+	}
+	for _, c := range cases {
+		p, log := fakePinentryProvider(t, fakeScript{Confirm: c.answer})
+		ok, err := p.Confirm("Replace report.pdf?")
+		if ok != c.ok || (err == nil) != (c.err == "") || (err != nil && err.Error() != c.err) {
+			t.Fatalf("%s: got %v, %v", c.answer, ok, err)
+		}
+		got := readCommands(t, log)
+		if len(got) < 3 || got[len(got)-3] != "SETDESC Replace report.pdf?" || got[len(got)-2] != "CONFIRM" {
+			t.Fatalf("%s: commands were %q", c.answer, got)
+		}
+	}
+}
+
+func TestPinentryMissingProgram(t *testing.T) {
+	p := &PinentryKeyProvider{Program: filepath.Join(os.TempDir(), "gocryptor-no-such-pinentry")}
+	_, err := p.Password(false)
+	if err == nil || !strings.HasPrefix(err.Error(), "unable to start pinentry: ") {
+		t.Fatalf("got %v", err)
+	}
+}
@@ -0,0 +1,141 @@
+package encryptor
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// chunkFunc seals or opens chunk index of a stream, appending the result to dst
+type chunkFunc func(dst, src []byte, index uint32, last bool) ([]byte, error)
+
+// chunkJob carries one chunk through the pipeline, done is closed once out or err is set
+type chunkJob struct {
+	index uint32
+	last  bool
+	in    []byte
+	out   []byte
+	err   error
+	done  chan struct{}
+}
+
+// processChunks reads chunks of inSize bytes from br, runs fn over them on up to workers goroutines
+// and writes the results to w in stream order. Chunks are independent, each has its own nonce, so
+// only the reading and writing are sequential. At most two chunks per worker are held at once, and
+// nothing after a chunk that fails is written.
+func processChunks(w io.Writer, br *bufio.Reader, inSize, outSize, workers int, fn chunkFunc) error {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers == 1 {
+		return processChunksInline(w, br, inSize, outSize, fn)
+	}
+	slots := 2 * workers
+	// buffers are only allocated as the stream needs them so a small file costs one chunk
+	free := make(chan *chunkJob, slots)
+	allocated := 0
+	order := make(chan *chunkJob, slots)
+	work := make(chan *chunkJob, slots)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range work {
+				job.out, job.err = fn(job.out[:0], job.in, job.index, job.last)
+				close(job.done)
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(work)
+		defer close(order)
+		for index := uint32(0); ; index++ {
+			var job *chunkJob
+			select {
+			case job = <-free:
+			case <-stop:
+				return
+			default:
+				if allocated < slots {
+					allocated++
+					job = &chunkJob{in: make([]byte, inSize), out: make([]byte, 0, outSize)}
+				} else {
+					select {
+					case job = <-free:
+					case <-stop:
+						return
+					}
+				}
+			}
+			job.index, job.done, job.err = index, make(chan struct{}), nil
+			var n int
+			job.last, n, job.err = readChunk(br, job.in[:inSize])
+			job.in = job.in[:n]
+			if job.err != nil {
+				close(job.done)
+				order <- job
+				return
+			}
+			order <- job
+			work <- job
+			if job.last {
+				return
+			}
+		}
+	}()
+	err := writeChunks(w, order, free)
+	close(stop)
+	// let the reader and workers finish with their buffers before the reader is handed back
+	for range order {
+	}
+	wg.Wait()
+	return err
+}
+
+// writeChunks writes finished chunks in order until the last one or the first failure
+func writeChunks(w io.Writer, order <-chan *chunkJob, free chan<- *chunkJob) error {
+	for job := range order {
+		<-job.done
+		if job.err != nil {
+			return job.err
+		}
+		_, err := w.Write(job.out)
+		if err != nil {
+			return errors.New("write error: " + err.Error())
+		}
+		if job.last {
+			return nil
+		}
+		free <- job
+	}
+	return errors.New("read error: stream ended early")
+}
+
+// processChunksInline is processChunks on the calling goroutine
+func processChunksInline(w io.Writer, br *bufio.Reader, inSize, outSize int, fn chunkFunc) error {
+	in := make([]byte, inSize)
+	out := make([]byte, 0, outSize)
+	for index := uint32(0); ; index++ {
+		last, n, err := readChunk(br, in)
+		if err != nil {
+			return err
+		}
+		out, err = fn(out[:0], in[:n], index, last)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(out)
+		if err != nil {
+			return errors.New("write error: " + err.Error())
+		}
+		if last {
+			return nil
+		}
+	}
+}
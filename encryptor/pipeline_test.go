@@ -0,0 +1,234 @@
+package encryptor
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// testKDF keeps password stretching cheap in tests
+var testKDF = KDFParams{N: 1024, R: 8, P: 1}
+
+// testData returns n bytes that differ from chunk to chunk
+func testData(n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(data)
+	return data
+}
+
+// concurrencies are the worker counts the tests and benchmarks try, from 1 up to GOMAXPROCS
+func concurrencies() []int {
+	max := runtime.GOMAXPROCS(0)
+	var counts []int
+	for c := 1; c < max; c *= 2 {
+		counts = append(counts, c)
+	}
+	counts = append(counts, max)
+	if max < 4 {
+		// more workers than CPUs still has to keep the chunks in order
+		counts = append(counts, 4)
+	}
+	return counts
+}
+
+func TestProcessChunksOrder(t *testing.T) {
+	data := testData(50*100 + 7)
+	for _, workers := range []int{1, 2, 3, 8} {
+		// earlier chunks take longer so they finish out of order
+		slow := func(dst, src []byte, index uint32, last bool) ([]byte, error) {
+			time.Sleep(time.Duration(50-index%50) * 20 * time.Microsecond)
+			return append(dst, src...), nil
+		}
+		var out bytes.Buffer
+		err := processChunks(&out, bufio.NewReader(bytes.NewReader(data)), 100, 100, workers, slow)
+		if err != nil {
+			t.Fatalf("%d workers: %v", workers, err)
+		}
+		if !bytes.Equal(out.Bytes(), data) {
+			t.Fatalf("%d workers: chunks were written out of order", workers)
+		}
+	}
+}
+
+func TestProcessChunksStopsAtFailure(t *testing.T) {
+	data := testData(100 * 100)
+	for _, workers := range []int{1, 4} {
+		fail := func(dst, src []byte, index uint32, last bool) ([]byte, error) {
+			if index == 10 {
+				return nil, ErrCorrupt
+			}
+			return append(dst, src...), nil
+		}
+		var out bytes.Buffer
+		err := processChunks(&out, bufio.NewReader(bytes.NewReader(data)), 100, 100, workers, fail)
+		if err != ErrCorrupt {
+			t.Fatalf("%d workers: got %v, want ErrCorrupt", workers, err)
+		}
+		if !bytes.Equal(out.Bytes(), data[:10*100]) {
+			t.Fatalf("%d workers: wrote %d bytes, want the %d before the failed chunk", workers, out.Len(), 10*100)
+		}
+	}
+}
+
+func TestConcurrencyRoundTrip(t *testing.T) {
+	sizes := []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3 * chunkSize, 10*chunkSize + 5}
+	for _, size := range sizes {
+		data := testData(size)
+		var first []byte
+		for _, workers := range concurrencies() {
+			var sealed bytes.Buffer
+			// the same randomness gives the same file, whatever the concurrency
+			opts := &Options{Password: "pw", KDF: testKDF, Rand: rand.New(rand.NewSource(1)), Concurrency: workers}
+			err := EncryptWithOptions(&sealed, bytes.NewReader(data), opts)
+			if err != nil {
+				t.Fatalf("size %d, %d workers: encrypt: %v", size, workers, err)
+			}
+			if first == nil {
+				first = sealed.Bytes()
+			} else if !bytes.Equal(sealed.Bytes(), first) {
+				t.Fatalf("size %d, %d workers: output differs from 1 worker", size, workers)
+			}
+			var opened bytes.Buffer
+			_, err = DecryptWithOptions(&opened, bytes.NewReader(sealed.Bytes()), &Options{Password: "pw", Concurrency: workers})
+			if err != nil {
+				t.Fatalf("size %d, %d workers: decrypt: %v", size, workers, err)
+			}
+			if !bytes.Equal(opened.Bytes(), data) {
+				t.Fatalf("size %d, %d workers: decrypted data differs", size, workers)
+			}
+		}
+	}
+}
+
+func TestTruncatedAtChunkBoundary(t *testing.T) {
+	const chunks = 4
+	data := testData(chunks * chunkSize)
+	var sealed bytes.Buffer
+	err := EncryptWithOptions(&sealed, bytes.NewReader(data), &Options{Password: "pw", KDF: testKDF})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealedChunk := chunkSize + 16
+	headerLength := sealed.Len() - chunks*sealedChunk
+	for _, workers := range []int{1, 4} {
+		for kept := 0; kept < chunks; kept++ {
+			truncated := sealed.Bytes()[:headerLength+kept*sealedChunk]
+			var opened bytes.Buffer
+			_, err := DecryptWithOptions(&opened, bytes.NewReader(truncated), &Options{Password: "pw", Concurrency: workers})
+			if err != ErrCorrupt {
+				t.Fatalf("%d workers, %d of %d chunks: got %v, want ErrCorrupt", workers, kept, chunks, err)
+			}
+			if opened.Len() > kept*chunkSize || !bytes.Equal(opened.Bytes(), data[:opened.Len()]) {
+				t.Fatalf("%d workers, %d of %d chunks: wrote %d bytes that were not authenticated", workers, kept, chunks, opened.Len())
+			}
+		}
+	}
+}
+
+// endless is a reader that never runs out
+type endless struct{}
+
+func (endless) Read(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func TestEncryptCancel(t *testing.T) {
+	for _, workers := range []int{1, 4} {
+		ctx, cancel := context.WithCancel(context.Background())
+		opts := &Options{Password: "pw", KDF: testKDF, Concurrency: workers, Progress: func(p Progress) {
+			if p.Done > 10*chunkSize {
+				cancel()
+			}
+		}}
+		done := make(chan error, 1)
+		go func() {
+			done <- EncryptContext(ctx, ioutil.Discard, endless{}, opts)
+		}()
+		select {
+		case err := <-done:
+			if err != context.Canceled {
+				t.Fatalf("%d workers: got %v, want context.Canceled", workers, err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%d workers: encrypt did not stop once cancelled", workers)
+		}
+		cancel()
+	}
+}
+
+func TestDecryptCancel(t *testing.T) {
+	data := testData(20 * chunkSize)
+	var sealed bytes.Buffer
+	err := EncryptWithOptions(&sealed, bytes.NewReader(data), &Options{Password: "pw", KDF: testKDF})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, workers := range []int{1, 4} {
+		ctx, cancel := context.WithCancel(context.Background())
+		opts := &Options{Password: "pw", Concurrency: workers, Progress: func(p Progress) {
+			if p.Done > 5*chunkSize {
+				cancel()
+			}
+		}}
+		var opened bytes.Buffer
+		_, err := DecryptContext(ctx, &opened, bytes.NewReader(sealed.Bytes()), opts)
+		if err != context.Canceled {
+			t.Fatalf("%d workers: got %v, want context.Canceled", workers, err)
+		}
+		if opened.Len() >= len(data) || !bytes.Equal(opened.Bytes(), data[:opened.Len()]) {
+			t.Fatalf("%d workers: wrote %d bytes after being cancelled", workers, opened.Len())
+		}
+		cancel()
+	}
+}
+
+// benchmarkSize is large enough to keep every worker busy
+const benchmarkSize = 32 << 20
+
+func BenchmarkEncrypt(b *testing.B) {
+	data := testData(benchmarkSize)
+	wrapper := newPasswordWrapper("pw", nil, testKDF, crand.Reader)
+	for _, workers := range concurrencies() {
+		b.Run(fmt.Sprintf("Concurrency=%d", workers), func(b *testing.B) {
+			opts := &Options{Wrapper: wrapper, Concurrency: workers}
+			b.SetBytes(benchmarkSize)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				err := EncryptWithOptions(ioutil.Discard, bytes.NewReader(data), opts)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkDecrypt(b *testing.B) {
+	data := testData(benchmarkSize)
+	wrapper := newPasswordWrapper("pw", nil, testKDF, crand.Reader)
+	var sealed bytes.Buffer
+	err := EncryptWithOptions(&sealed, bytes.NewReader(data), &Options{Wrapper: wrapper})
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, workers := range concurrencies() {
+		b.Run(fmt.Sprintf("Concurrency=%d", workers), func(b *testing.B) {
+			opts := &Options{Wrapper: wrapper, Concurrency: workers}
+			b.SetBytes(benchmarkSize)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := DecryptWithOptions(ioutil.Discard, bytes.NewReader(sealed.Bytes()), opts)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
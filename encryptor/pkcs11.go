@@ -0,0 +1,20 @@
+package encryptor
+
+const (
+	pkcs11AESSlotType = "pkcs11-aes"
+	pkcs11RSASlotType = "pkcs11-rsa"
+	// pkcs11TagBits is the CKM_AES_GCM tag length, a wrong token key fails this check
+	pkcs11TagBits = 128
+)
+
+// PKCS11Config describes which token key wraps the per file data keys
+type PKCS11Config struct {
+	// Module is the path to the PKCS#11 library, for SoftHSM2 usually /usr/lib/softhsm/libsofthsm2.so
+	Module string
+	// Slot is the ID of the slot holding the token
+	Slot uint
+	// Label is the CKA_LABEL of the AES secret key or RSA key pair on the token
+	Label string
+	// PIN is the user PIN used to log in to the token
+	PIN string
+}
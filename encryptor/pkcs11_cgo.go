@@ -0,0 +1,212 @@
+// +build cgo
+
+package encryptor
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+)
+
+// PKCS11Wrapper wraps and unwraps data keys with a key that never leaves a PKCS#11 token
+type PKCS11Wrapper struct {
+	ctx *pkcs11.Ctx
+	// mu serialises use of the session, a session runs one operation at a time
+	mu         sync.Mutex
+	session    pkcs11.SessionHandle
+	label      string
+	slotType   string
+	secretKey  pkcs11.ObjectHandle
+	publicKey  pkcs11.ObjectHandle
+	privateKey pkcs11.ObjectHandle
+}
+
+// NewPKCS11Wrapper loads the module, logs in to the token and finds the key with the configured label.
+// An AES secret key is preferred, otherwise an RSA key pair with that label is used.
+func NewPKCS11Wrapper(config PKCS11Config) (*PKCS11Wrapper, error) {
+	ctx := pkcs11.New(config.Module)
+	if ctx == nil {
+		return nil, errors.New("unable to load PKCS#11 module: " + config.Module)
+	}
+	err := ctx.Initialize()
+	if err != nil {
+		ctx.Destroy()
+		return nil, errors.New("PKCS#11 initialize error: " + err.Error())
+	}
+	w := &PKCS11Wrapper{ctx: ctx, label: config.Label}
+	w.session, err = ctx.OpenSession(config.Slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		ctx.Finalize()
+		ctx.Destroy()
+		return nil, errors.New("PKCS#11 open session error: " + err.Error())
+	}
+	err = ctx.Login(w.session, pkcs11.CKU_USER, config.PIN)
+	if err != nil && err != pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+		w.Close()
+		return nil, errors.New("PKCS#11 login error: " + err.Error())
+	}
+	err = w.findKeys()
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// findKeys looks up the AES key, or failing that the RSA key pair, matching the label
+func (w *PKCS11Wrapper) findKeys() error {
+	secretKey, err := w.findObject(pkcs11.CKO_SECRET_KEY)
+	if err != nil {
+		return err
+	}
+	if secretKey != 0 {
+		w.secretKey = secretKey
+		w.slotType = pkcs11AESSlotType
+		return nil
+	}
+	w.publicKey, err = w.findObject(pkcs11.CKO_PUBLIC_KEY)
+	if err != nil {
+		return err
+	}
+	w.privateKey, err = w.findObject(pkcs11.CKO_PRIVATE_KEY)
+	if err != nil {
+		return err
+	}
+	if w.publicKey == 0 && w.privateKey == 0 {
+		return errors.New("no AES or RSA key found on token with label: " + w.label)
+	}
+	w.slotType = pkcs11RSASlotType
+	return nil
+}
+
+// findObject returns the first object of the class with our label, or 0 if there is none
+func (w *PKCS11Wrapper) findObject(class uint) (pkcs11.ObjectHandle, error) {
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, w.label),
+	}
+	err := w.ctx.FindObjectsInit(w.session, template)
+	if err != nil {
+		return 0, errors.New("PKCS#11 find objects error: " + err.Error())
+	}
+	defer w.ctx.FindObjectsFinal(w.session)
+	objects, _, err := w.ctx.FindObjects(w.session, 1)
+	if err != nil {
+		return 0, errors.New("PKCS#11 find objects error: " + err.Error())
+	}
+	if len(objects) == 0 {
+		return 0, nil
+	}
+	return objects[0], nil
+}
+
+// Close logs out of the token and unloads the module
+func (w *PKCS11Wrapper) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.ctx.Logout(w.session)
+	w.ctx.CloseSession(w.session)
+	err := w.ctx.Finalize()
+	w.ctx.Destroy()
+	return err
+}
+
+// WrapKey encrypts the data key on the token, AES keys use GCM with a random IV so a wrong
+// key is caught when unwrapping, while RSA keys use OAEP
+func (w *PKCS11Wrapper) WrapKey(dataKey []byte) (KeySlot, error) {
+	slot := KeySlot{Type: w.slotType, KeyID: w.label}
+	if w.slotType == pkcs11AESSlotType {
+		iv := make([]byte, nonceLength)
+		_, err := io.ReadFull(rand.Reader, iv)
+		if err != nil {
+			return KeySlot{}, errors.New("random data read error: " + err.Error())
+		}
+		params := pkcs11.NewGCMParams(iv, nil, pkcs11TagBits)
+		defer params.Free()
+		wrappedKey, err := w.encrypt(pkcs11.NewMechanism(pkcs11.CKM_AES_GCM, params), w.secretKey, dataKey)
+		if err != nil {
+			return KeySlot{}, err
+		}
+		// some tokens pick their own IV, so store the one that was used
+		iv = params.IV()
+		if len(iv) != nonceLength {
+			return KeySlot{}, errors.New("PKCS#11 token returned an unexpected GCM IV length")
+		}
+		slot.WrappedKey = append(iv, wrappedKey...)
+		return slot, nil
+	}
+	if w.publicKey == 0 {
+		return KeySlot{}, errors.New("no RSA public key found on token with label: " + w.label)
+	}
+	wrappedKey, err := w.encrypt(oaepMechanism(), w.publicKey, dataKey)
+	if err != nil {
+		return KeySlot{}, err
+	}
+	slot.WrappedKey = wrappedKey
+	return slot, nil
+}
+
+// Matches reports whether the slot was wrapped by this token key
+func (w *PKCS11Wrapper) Matches(slot KeySlot) bool {
+	return slot.Type == w.slotType && slot.KeyID == w.label
+}
+
+// UnwrapKey decrypts a data key previously wrapped by this token key, returning ErrWrongKey
+// if the token key with this label is not the one that wrapped it
+func (w *PKCS11Wrapper) UnwrapKey(slot KeySlot) ([]byte, error) {
+	if !w.Matches(slot) {
+		return nil, errors.New("key slot was not wrapped by token key: " + w.label)
+	}
+	if w.slotType == pkcs11AESSlotType {
+		if len(slot.WrappedKey) < nonceLength+pkcs11TagBits/8 {
+			return nil, errors.New("wrapped key is truncated")
+		}
+		iv, wrappedKey := slot.WrappedKey[:nonceLength], slot.WrappedKey[nonceLength:]
+		params := pkcs11.NewGCMParams(iv, nil, pkcs11TagBits)
+		defer params.Free()
+		return w.decrypt(pkcs11.NewMechanism(pkcs11.CKM_AES_GCM, params), w.secretKey, wrappedKey)
+	}
+	if w.privateKey == 0 {
+		return nil, errors.New("no RSA private key found on token with label: " + w.label)
+	}
+	return w.decrypt(oaepMechanism(), w.privateKey, slot.WrappedKey)
+}
+
+func (w *PKCS11Wrapper) encrypt(mechanism *pkcs11.Mechanism, key pkcs11.ObjectHandle, data []byte) ([]byte, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	err := w.ctx.EncryptInit(w.session, []*pkcs11.Mechanism{mechanism}, key)
+	if err != nil {
+		return nil, errors.New("PKCS#11 encrypt init error: " + err.Error())
+	}
+	out, err := w.ctx.Encrypt(w.session, data)
+	if err != nil {
+		return nil, errors.New("PKCS#11 encrypt error: " + err.Error())
+	}
+	return out, nil
+}
+
+// decrypt reports a failed C_Decrypt as ErrWrongKey, once the operation has started the GCM tag
+// or OAEP decoding is what fails and tokens differ in which error they return for it
+func (w *PKCS11Wrapper) decrypt(mechanism *pkcs11.Mechanism, key pkcs11.ObjectHandle, data []byte) ([]byte, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	err := w.ctx.DecryptInit(w.session, []*pkcs11.Mechanism{mechanism}, key)
+	if err != nil {
+		return nil, errors.New("PKCS#11 decrypt init error: " + err.Error())
+	}
+	out, err := w.ctx.Decrypt(w.session, data)
+	if err != nil {
+		return nil, ErrWrongKey
+	}
+	return out, nil
+}
+
+// oaepMechanism uses SHA-1, the only OAEP hash SoftHSM2 supports
+func oaepMechanism() *pkcs11.Mechanism {
+	params := pkcs11.NewOAEPParams(pkcs11.CKM_SHA_1, pkcs11.CKG_MGF1_SHA1, pkcs11.CKZ_DATA_SPECIFIED, nil)
+	return pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_OAEP, params)
+}
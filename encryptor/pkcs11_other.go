@@ -0,0 +1,36 @@
+// +build !cgo
+
+package encryptor
+
+import "errors"
+
+// errNoPKCS11 is returned when goCryptor was built without cgo, which the PKCS#11 bindings need
+var errNoPKCS11 = errors.New("PKCS#11 tokens are not supported in builds without cgo")
+
+// PKCS11Wrapper wraps and unwraps data keys with a key that never leaves a PKCS#11 token
+type PKCS11Wrapper struct{}
+
+// NewPKCS11Wrapper always fails, PKCS#11 modules can only be loaded with cgo
+func NewPKCS11Wrapper(config PKCS11Config) (*PKCS11Wrapper, error) {
+	return nil, errNoPKCS11
+}
+
+// Close does nothing
+func (w *PKCS11Wrapper) Close() error {
+	return nil
+}
+
+// WrapKey always fails
+func (w *PKCS11Wrapper) WrapKey(dataKey []byte) (KeySlot, error) {
+	return KeySlot{}, errNoPKCS11
+}
+
+// Matches reports false, no slot can be unwrapped
+func (w *PKCS11Wrapper) Matches(slot KeySlot) bool {
+	return false
+}
+
+// UnwrapKey always fails
+func (w *PKCS11Wrapper) UnwrapKey(slot KeySlot) ([]byte, error) {
+	return nil, errNoPKCS11
+}
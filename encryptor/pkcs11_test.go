@@ -0,0 +1,277 @@
+// +build cgo
+
+package encryptor
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+)
+
+const (
+	testTokenLabel = "gocryptor"
+	testPIN        = "1234"
+	testAESLabel   = "filekey"
+	testRSALabel   = "rsakey"
+)
+
+// softHSMModules are where SoftHSM2 is usually installed, SOFTHSM2_MODULE overrides them
+var softHSMModules = []string{
+	"/usr/lib/softhsm/libsofthsm2.so",
+	"/usr/lib/x86_64-linux-gnu/softhsm/libsofthsm2.so",
+	"/usr/lib64/pkcs11/libsofthsm2.so",
+	"/usr/local/lib/softhsm/libsofthsm2.so",
+	"/opt/homebrew/lib/softhsm/libsofthsm2.so",
+}
+
+// softHSMToken initialises a token in a fresh SoftHSM2 store holding an AES key and an RSA key
+// pair, skipping the test when SoftHSM2 is not installed
+func softHSMToken(t *testing.T) PKCS11Config {
+	module := os.Getenv("SOFTHSM2_MODULE")
+	if module == "" {
+		for _, path := range softHSMModules {
+			if _, err := os.Stat(path); err == nil {
+				module = path
+				break
+			}
+		}
+	}
+	if module == "" {
+		t.Skip("SoftHSM2 is not installed, set SOFTHSM2_MODULE to its library to run this test")
+	}
+	dir, err := ioutil.TempDir("", "gocryptor-softhsm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	tokens := filepath.Join(dir, "tokens")
+	conf := filepath.Join(dir, "softhsm2.conf")
+	err = os.Mkdir(tokens, 0700)
+	if err == nil {
+		err = ioutil.WriteFile(conf, []byte("directories.tokendir = "+tokens+"\nobjectstore.backend = file\n"), 0600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous, had := os.LookupEnv("SOFTHSM2_CONF")
+	os.Setenv("SOFTHSM2_CONF", conf)
+	t.Cleanup(func() {
+		if had {
+			os.Setenv("SOFTHSM2_CONF", previous)
+		} else {
+			os.Unsetenv("SOFTHSM2_CONF")
+		}
+	})
+
+	config := PKCS11Config{Module: module, PIN: testPIN}
+	withToken(t, module, func(ctx *pkcs11.Ctx) {
+		slots, err := ctx.GetSlotList(false)
+		if err != nil || len(slots) == 0 {
+			t.Fatalf("no free SoftHSM2 slot: %v", err)
+		}
+		err = ctx.InitToken(slots[0], testPIN, testTokenLabel)
+		if err != nil {
+			t.Fatal("init token:", err)
+		}
+	})
+	// SoftHSM2 moves an initialised token to a new slot, so look it up again
+	withToken(t, module, func(ctx *pkcs11.Ctx) {
+		slots, err := ctx.GetSlotList(true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, slot := range slots {
+			info, err := ctx.GetTokenInfo(slot)
+			if err == nil && info.Label == testTokenLabel {
+				config.Slot = slot
+			}
+		}
+		session := openSession(t, ctx, config.Slot, pkcs11.CKU_SO)
+		err = ctx.InitPIN(session, testPIN)
+		if err != nil {
+			t.Fatal("init PIN:", err)
+		}
+	})
+	replaceAESKey(t, config)
+	withToken(t, module, func(ctx *pkcs11.Ctx) {
+		session := openSession(t, ctx, config.Slot, pkcs11.CKU_USER)
+		public := []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, testRSALabel),
+			pkcs11.NewAttribute(pkcs11.CKA_ENCRYPT, true),
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS_BITS, 2048),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, []byte{1, 0, 1}),
+		}
+		private := []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, testRSALabel),
+			pkcs11.NewAttribute(pkcs11.CKA_DECRYPT, true),
+			pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		}
+		_, _, err := ctx.GenerateKeyPair(session, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN, nil)}, public, private)
+		if err != nil {
+			t.Fatal("generate RSA key pair:", err)
+		}
+	})
+	return config
+}
+
+// replaceAESKey generates a new AES key labelled testAESLabel, destroying any old one
+func replaceAESKey(t *testing.T, config PKCS11Config) {
+	withToken(t, config.Module, func(ctx *pkcs11.Ctx) {
+		session := openSession(t, ctx, config.Slot, pkcs11.CKU_USER)
+		label := []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_LABEL, testAESLabel)}
+		err := ctx.FindObjectsInit(session, label)
+		if err != nil {
+			t.Fatal(err)
+		}
+		old, _, err := ctx.FindObjects(session, 10)
+		ctx.FindObjectsFinal(session)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, object := range old {
+			err = ctx.DestroyObject(session, object)
+			if err != nil {
+				t.Fatal("destroy old key:", err)
+			}
+		}
+		template := []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, testAESLabel),
+			pkcs11.NewAttribute(pkcs11.CKA_ENCRYPT, true),
+			pkcs11.NewAttribute(pkcs11.CKA_DECRYPT, true),
+			pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_VALUE_LEN, 32),
+		}
+		_, err = ctx.GenerateKey(session, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_AES_KEY_GEN, nil)}, template)
+		if err != nil {
+			t.Fatal("generate AES key:", err)
+		}
+	})
+}
+
+// withToken loads the module for the length of setup, the wrapper under test loads it again
+func withToken(t *testing.T, module string, setup func(ctx *pkcs11.Ctx)) {
+	ctx := pkcs11.New(module)
+	if ctx == nil {
+		t.Fatal("unable to load " + module)
+	}
+	err := ctx.Initialize()
+	if err != nil {
+		ctx.Destroy()
+		t.Fatal("initialize:", err)
+	}
+	defer func() {
+		ctx.CloseAllSessions(0)
+		ctx.Finalize()
+		ctx.Destroy()
+	}()
+	setup(ctx)
+}
+
+func openSession(t *testing.T, ctx *pkcs11.Ctx, slot uint, user uint) pkcs11.SessionHandle {
+	session, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		t.Fatal("open session:", err)
+	}
+	err = ctx.Login(session, user, testPIN)
+	if err != nil {
+		t.Fatal("login:", err)
+	}
+	return session
+}
+
+func newTestPKCS11Wrapper(t *testing.T, config PKCS11Config, label string) *PKCS11Wrapper {
+	config.Label = label
+	w, err := NewPKCS11Wrapper(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func TestPKCS11RoundTrip(t *testing.T) {
+	config := softHSMToken(t)
+	for _, label := range []string{testAESLabel, testRSALabel} {
+		w := newTestPKCS11Wrapper(t, config, label)
+		data := testData(3*chunkSize + 11)
+		var sealed bytes.Buffer
+		err := EncryptWithOptions(&sealed, bytes.NewReader(data), &Options{Wrapper: w})
+		if err != nil {
+			t.Fatalf("%s: encrypt: %v", label, err)
+		}
+		var opened bytes.Buffer
+		_, err = DecryptWithOptions(&opened, bytes.NewReader(sealed.Bytes()), &Options{Wrapper: w})
+		if err != nil {
+			t.Fatalf("%s: decrypt: %v", label, err)
+		}
+		if !bytes.Equal(opened.Bytes(), data) {
+			t.Fatalf("%s: decrypted data differs", label)
+		}
+		w.Close()
+	}
+}
+
+func TestPKCS11Concurrent(t *testing.T) {
+	config := softHSMToken(t)
+	w := newTestPKCS11Wrapper(t, config, testAESLabel)
+	defer w.Close()
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			dataKey := bytes.Repeat([]byte{byte(i)}, 32)
+			for n := 0; n < 20; n++ {
+				slot, err := w.WrapKey(dataKey)
+				if err != nil {
+					errs <- err
+					return
+				}
+				unwrapped, err := w.UnwrapKey(slot)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if !bytes.Equal(unwrapped, dataKey) {
+					errs <- ErrCorrupt
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func TestPKCS11WrongKey(t *testing.T) {
+	config := softHSMToken(t)
+	w := newTestPKCS11Wrapper(t, config, testAESLabel)
+	slot, err := w.WrapKey(make([]byte, 32))
+	w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a different key under the same label still matches the slot but cannot open it
+	replaceAESKey(t, config)
+	w = newTestPKCS11Wrapper(t, config, testAESLabel)
+	defer w.Close()
+	if !w.Matches(slot) {
+		t.Fatal("slot should match a key with the same label")
+	}
+	_, err = w.UnwrapKey(slot)
+	if err != ErrWrongKey {
+		t.Fatalf("got %v, want ErrWrongKey", err)
+	}
+}
@@ -0,0 +1,49 @@
+package encryptor
+
+import (
+	"context"
+	"io"
+)
+
+// Progress is passed to Options.Progress as the input is read
+type Progress struct {
+	// File is the input file, empty for a stream
+	File string
+	// Done is how many bytes of the input have been read, Total is its size or 0 if it is not known
+	Done  int64
+	Total int64
+}
+
+// progressReader reports the bytes read through it and fails once its context is done, which stops
+// the chunk pipeline at the next read
+type progressReader struct {
+	ctx      context.Context
+	r        io.Reader
+	progress func(Progress)
+	report   Progress
+}
+
+func newProgressReader(ctx context.Context, r io.Reader, progress func(Progress), file string, total int64) *progressReader {
+	return &progressReader{ctx: ctx, r: r, progress: progress, report: Progress{File: file, Total: total}}
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	err := p.ctx.Err()
+	if err != nil {
+		return 0, err
+	}
+	n, err := p.r.Read(b)
+	p.report.Done += int64(n)
+	if n > 0 && p.progress != nil {
+		p.progress(p.report)
+	}
+	return n, err
+}
+
+// contextErr returns the context's error in place of the error it caused further down
+func contextErr(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
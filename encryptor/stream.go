@@ -0,0 +1,107 @@
+package encryptor
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+// Encrypt reads plaintext from r until EOF and writes it to w encrypted under a fresh data key
+// protected by the wrapper. fileExt is recorded in the header so decrypting to a file can restore it.
+func Encrypt(w io.Writer, r io.Reader, wrapper KeyWrapper, fileExt string) error {
+	return EncryptWithOptions(w, r, &Options{Wrapper: wrapper, Ext: fileExt})
+}
+
+// Decrypt reads encrypted data from r and writes the plaintext to w, returning the original extension.
+// Each chunk is written once it has been authenticated, so if an error is returned w may hold part of
+// the plaintext and should be discarded.
+func Decrypt(w io.Writer, r io.Reader, wrapper KeyWrapper) (string, error) {
+	result, err := DecryptWithOptions(w, r, &Options{Wrapper: wrapper})
+	if err != nil {
+		return "", err
+	}
+	return result.Ext, nil
+}
+
+// decryptLegacyStream handles files from before the container format, which have no header and
+// take the key straight from the password
+func decryptLegacyStream(w io.Writer, br *bufio.Reader, wrapper KeyWrapper) (*Result, error) {
+	passwordWrapper, ok := wrapper.(*PasswordWrapper)
+	if !ok {
+		return nil, errors.New("not a goCryptor file")
+	}
+	fileBytes, err := ioutil.ReadAll(br)
+	if err != nil {
+		return nil, errors.New("read error: " + err.Error())
+	}
+	plaintext, fileExt, err := decryptLegacy(passwordWrapper.password, fileBytes)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(plaintext)
+	if err != nil {
+		return nil, errors.New("write error: " + err.Error())
+	}
+	return &Result{Ext: string(fileExt)}, nil
+}
+
+// encryptStream writes the header then seals r chunk by chunk on up to workers goroutines, flagging
+// the final chunk
+func encryptStream(w io.Writer, r io.Reader, h *header, dataKey, aad []byte, workers int) error {
+	rawHeader, err := h.marshal()
+	if err != nil {
+		return err
+	}
+	aesgcm, err := newAEAD(h.Cipher, dataKey)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(rawHeader)
+	if err != nil {
+		return errors.New("write error: " + err.Error())
+	}
+	chunkAAD := append(rawHeader, aad...)
+	seal := func(dst, plaintext []byte, i uint32, last bool) ([]byte, error) {
+		return aesgcm.Seal(dst, chunkNonce(h.Nonce, i, last), plaintext, chunkAAD), nil
+	}
+	return processChunks(w, bufio.NewReader(r), h.ChunkSize, h.ChunkSize+aesgcm.Overhead(), workers, seal)
+}
+
+// decryptStream opens the chunks that follow the header on up to workers goroutines, a stream that
+// ends without the final chunk has been truncated and fails
+func decryptStream(w io.Writer, br *bufio.Reader, h *header, rawHeader, dataKey, aad []byte, workers int) error {
+	aesgcm, err := newAEAD(h.Cipher, dataKey)
+	if err != nil {
+		return err
+	}
+	chunkAAD := append(rawHeader[:len(rawHeader):len(rawHeader)], aad...)
+	open := func(dst, sealed []byte, i uint32, last bool) ([]byte, error) {
+		plaintext, err := aesgcm.Open(dst, chunkNonce(h.Nonce, i, last), sealed, chunkAAD)
+		if err != nil {
+			return nil, ErrCorrupt
+		}
+		return plaintext, nil
+	}
+	return processChunks(w, br, h.ChunkSize+aesgcm.Overhead(), h.ChunkSize, workers, open)
+}
+
+// readChunk fills buf as far as it can, reporting whether this is the last chunk of the stream
+func readChunk(br *bufio.Reader, buf []byte) (bool, int, error) {
+	n, err := io.ReadFull(br, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true, n, nil
+	}
+	if err != nil {
+		return false, n, errors.New("read error: " + err.Error())
+	}
+	// a full chunk is the last one only if nothing follows it
+	_, err = br.Peek(1)
+	if err == io.EOF {
+		return true, n, nil
+	}
+	if err != nil {
+		return false, n, errors.New("read error: " + err.Error())
+	}
+	return false, n, nil
+}
@@ -0,0 +1,10 @@
+// +build !linux,!darwin,!freebsd,!openbsd,!netbsd,!dragonfly
+
+package encryptor
+
+import "errors"
+
+// MoveToTrash is only supported where the freedesktop.org trash is
+func MoveToTrash(path string) error {
+	return errors.New("moving files to the trash is not supported on this platform")
+}
@@ -0,0 +1,146 @@
+// +build linux darwin freebsd openbsd netbsd dragonfly
+
+package encryptor
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// MoveToTrash moves path to the trash following the freedesktop.org trash specification, so file
+// managers can list and restore it. Files on another file system than the home trash go to the
+// trash at the top of their own file system, the shared .Trash/uid if the administrator has set up
+// .Trash and .Trash-uid otherwise.
+func MoveToTrash(path string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	trash, err := trashDirFor(abs)
+	if err != nil {
+		return err
+	}
+	for _, dir := range []string{filepath.Join(trash, "files"), filepath.Join(trash, "info")} {
+		err = os.MkdirAll(dir, 0700)
+		if err != nil {
+			return errors.New("unable to create trash: " + err.Error())
+		}
+	}
+	name, info, err := reserveTrashInfo(trash, filepath.Base(abs))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(info, "[Trash Info]\nPath=%s\nDeletionDate=%s\n", (&url.URL{Path: abs}).EscapedPath(), time.Now().Format("2006-01-02T15:04:05"))
+	infoPath := info.Name()
+	err = info.Close()
+	if err == nil {
+		err = os.Rename(abs, filepath.Join(trash, "files", name))
+	}
+	if err != nil {
+		os.Remove(infoPath)
+		return err
+	}
+	return nil
+}
+
+// reserveTrashInfo creates the .trashinfo file for the first free name, which also claims that name
+// in the files folder
+func reserveTrashInfo(trash, base string) (string, *os.File, error) {
+	ext := filepath.Ext(base)
+	stem := base[:len(base)-len(ext)]
+	name := base
+	for i := 2; ; i++ {
+		info, err := os.OpenFile(filepath.Join(trash, "info", name+".trashinfo"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			_, err = os.Lstat(filepath.Join(trash, "files", name))
+			if os.IsNotExist(err) {
+				return name, info, nil
+			}
+			info.Close()
+			os.Remove(info.Name())
+		} else if !os.IsExist(err) {
+			return "", nil, errors.New("unable to write to trash: " + err.Error())
+		}
+		name = stem + "." + strconv.Itoa(i) + ext
+	}
+}
+
+// trashDirFor picks the home trash when path is on the same file system, otherwise the trash at the
+// top of path's file system
+func trashDirFor(path string) (string, error) {
+	dataHome := os.Getenv("XDG_DATA_HOME")
+	if dataHome == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", errors.New("unable to find the trash: " + err.Error())
+		}
+		dataHome = filepath.Join(home, ".local", "share")
+	}
+	home := filepath.Join(dataHome, "Trash")
+	fileDev, err := deviceOf(path)
+	if err != nil {
+		return "", err
+	}
+	// the trash may not exist yet, its nearest existing parent decides which file system it is on
+	homeDev, err := deviceOf(existingParent(home))
+	if err != nil {
+		return "", err
+	}
+	if fileDev == homeDev {
+		return home, nil
+	}
+	top := filepath.Dir(path)
+	for top != filepath.Dir(top) {
+		dev, err := deviceOf(filepath.Dir(top))
+		if err != nil || dev != fileDev {
+			break
+		}
+		top = filepath.Dir(top)
+	}
+	return topTrashDir(top), nil
+}
+
+// topTrashDir picks the user's folder in top/.Trash if that is a real folder with the sticky bit
+// set, as the specification requires before trusting it, and top/.Trash-uid otherwise
+func topTrashDir(top string) string {
+	uid := strconv.Itoa(os.Getuid())
+	shared := filepath.Join(top, ".Trash")
+	info, err := os.Lstat(shared)
+	if err == nil && info.IsDir() && info.Mode()&os.ModeSticky != 0 {
+		userTrash := filepath.Join(shared, uid)
+		err = os.Mkdir(userTrash, 0700)
+		if err == nil || os.IsExist(err) {
+			info, err = os.Lstat(userTrash)
+			if err == nil && info.IsDir() {
+				return userTrash
+			}
+		}
+	}
+	return filepath.Join(top, ".Trash-"+uid)
+}
+
+func existingParent(path string) string {
+	for {
+		_, err := os.Stat(path)
+		if err == nil || path == filepath.Dir(path) {
+			return path
+		}
+		path = filepath.Dir(path)
+	}
+}
+
+func deviceOf(path string) (uint64, error) {
+	var st unix.Stat_t
+	err := unix.Stat(path, &st)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(st.Dev), nil
+}
@@ -0,0 +1,126 @@
+// +build linux darwin freebsd openbsd netbsd dragonfly
+
+package encryptor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestTopTrashDir(t *testing.T) {
+	uid := strconv.Itoa(os.Getuid())
+	cases := []struct {
+		name string
+		// setup prepares top/.Trash, if anything
+		setup  func(t *testing.T, top string)
+		shared bool
+	}{
+		{"no .Trash", func(t *testing.T, top string) {}, false},
+		{"sticky .Trash", func(t *testing.T, top string) {
+			mkdirMode(t, filepath.Join(top, ".Trash"), os.ModeSticky|0777)
+		}, true},
+		{"sticky .Trash with the user's folder", func(t *testing.T, top string) {
+			mkdirMode(t, filepath.Join(top, ".Trash"), os.ModeSticky|0777)
+			mkdirMode(t, filepath.Join(top, ".Trash", uid), 0700)
+		}, true},
+		{".Trash without the sticky bit", func(t *testing.T, top string) {
+			mkdirMode(t, filepath.Join(top, ".Trash"), 0777)
+		}, false},
+		{".Trash a symlink to a sticky folder", func(t *testing.T, top string) {
+			mkdirMode(t, filepath.Join(top, "elsewhere"), os.ModeSticky|0777)
+			os.Symlink("elsewhere", filepath.Join(top, ".Trash"))
+		}, false},
+		{".Trash a file", func(t *testing.T, top string) {
+			ioutil.WriteFile(filepath.Join(top, ".Trash"), nil, 0644)
+		}, false},
+		{"the user's folder a symlink", func(t *testing.T, top string) {
+			mkdirMode(t, filepath.Join(top, ".Trash"), os.ModeSticky|0777)
+			mkdirMode(t, filepath.Join(top, "elsewhere"), 0700)
+			os.Symlink("../elsewhere", filepath.Join(top, ".Trash", uid))
+		}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			top, err := ioutil.TempDir("", "gocryptor-trash")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(top)
+			c.setup(t, top)
+			want := filepath.Join(top, ".Trash-"+uid)
+			if c.shared {
+				want = filepath.Join(top, ".Trash", uid)
+			}
+			if got := topTrashDir(top); got != want {
+				t.Fatalf("got %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func mkdirMode(t *testing.T, path string, mode os.FileMode) {
+	err := os.Mkdir(path, 0700)
+	if err == nil {
+		// Chmod rather than the umask decides the bits, and takes the sticky bit
+		err = os.Chmod(path, mode)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMoveToTrash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gocryptor-trash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dataHome, hadDataHome := os.LookupEnv("XDG_DATA_HOME")
+	os.Setenv("XDG_DATA_HOME", filepath.Join(dir, "data"))
+	t.Cleanup(func() {
+		if hadDataHome {
+			os.Setenv("XDG_DATA_HOME", dataHome)
+		} else {
+			os.Unsetenv("XDG_DATA_HOME")
+		}
+	})
+	trash := filepath.Join(dir, "data", "Trash")
+	// the second file of the same name gets a numbered entry
+	for i, name := range []string{"my file.txt", "my file.2.txt"} {
+		path := filepath.Join(dir, "my file.txt")
+		err = ioutil.WriteFile(path, []byte{byte(i)}, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = MoveToTrash(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Lstat(path); !os.IsNotExist(err) {
+			t.Fatal("the file is still in place")
+		}
+		data, err := ioutil.ReadFile(filepath.Join(trash, "files", name))
+		if err != nil || len(data) != 1 || data[0] != byte(i) {
+			t.Fatalf("files/%s: %v %v", name, data, err)
+		}
+		info, err := ioutil.ReadFile(filepath.Join(trash, "info", name+".trashinfo"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(string(info), "\n")
+		if len(lines) != 4 || lines[0] != "[Trash Info]" || lines[1] != "Path="+strings.Replace(path, " ", "%20", -1) ||
+			!strings.HasPrefix(lines[2], "DeletionDate=") || len(lines[2]) != len("DeletionDate=2006-01-02T15:04:05") {
+			t.Fatalf("%s.trashinfo:\n%s", name, info)
+		}
+	}
+	for _, sub := range []string{"files", "info"} {
+		fi, err := os.Stat(filepath.Join(trash, sub))
+		if err != nil || fi.Mode().Perm() != 0700 {
+			t.Fatalf("%s: %v %v", sub, fi.Mode(), err)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package encryptor
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const vaultSlotType = "vault-transit"
+
+// VaultTransitConfig points at a transit secrets engine speaking the HashiCorp Vault HTTP API
+type VaultTransitConfig struct {
+	// Address is the base URL of the server, for example https://vault.example.com:8200
+	Address string
+	// Token is sent as X-Vault-Token on every request
+	Token string
+	// Namespace is sent as X-Vault-Namespace when set
+	Namespace string
+	// Mount is the path the transit engine is mounted at, defaults to transit
+	Mount string
+	// KeyName is the name of the transit key that wraps data keys, it cannot contain /, ?, # or ..
+	KeyName string
+	// Client is the HTTP client to use, defaults to one with a 30 second timeout
+	Client *http.Client
+}
+
+// VaultTransitWrapper requests data keys from a transit engine and has it unwrap them on decrypt,
+// so the master key never leaves the KMS
+type VaultTransitWrapper struct {
+	config VaultTransitConfig
+}
+
+// vaultResponse covers the fields we use from the transit datakey, encrypt and decrypt endpoints
+type vaultResponse struct {
+	Data struct {
+		Plaintext  string `json:"plaintext"`
+		Ciphertext string `json:"ciphertext"`
+	} `json:"data"`
+	Errors []string `json:"errors"`
+}
+
+// NewVaultTransitWrapper checks the config and fills in defaults
+func NewVaultTransitWrapper(config VaultTransitConfig) (*VaultTransitWrapper, error) {
+	if config.Address == "" || config.KeyName == "" {
+		return nil, errors.New("vault address and key name are required")
+	}
+	// the name is one segment of the request path, it must not reach another endpoint
+	if strings.ContainsAny(config.KeyName, "/?#") || strings.Contains(config.KeyName, "..") {
+		return nil, errors.New("invalid vault key name: " + config.KeyName)
+	}
+	if config.Mount == "" {
+		config.Mount = "transit"
+	}
+	if config.Client == nil {
+		config.Client = &http.Client{Timeout: 30 * time.Second}
+	}
+	config.Address = strings.TrimSuffix(config.Address, "/")
+	return &VaultTransitWrapper{config: config}, nil
+}
+
+// GenerateDataKey asks the KMS for a new 256 bit data key, returning the plaintext key and its wrapped form
+func (w *VaultTransitWrapper) GenerateDataKey() ([]byte, KeySlot, error) {
+	resp, err := w.call("datakey/plaintext", map[string]interface{}{"bits": dataKeyLength * 8})
+	if err != nil {
+		return nil, KeySlot{}, err
+	}
+	dataKey, err := base64.StdEncoding.DecodeString(resp.Data.Plaintext)
+	if err != nil || len(dataKey) != dataKeyLength {
+		return nil, KeySlot{}, errors.New("vault returned an invalid data key")
+	}
+	if resp.Data.Ciphertext == "" {
+		return nil, KeySlot{}, errors.New("vault returned no wrapped data key")
+	}
+	return dataKey, w.slot(resp.Data.Ciphertext), nil
+}
+
+// WrapKey has the KMS encrypt an existing data key
+func (w *VaultTransitWrapper) WrapKey(dataKey []byte) (KeySlot, error) {
+	resp, err := w.call("encrypt", map[string]interface{}{"plaintext": base64.StdEncoding.EncodeToString(dataKey)})
+	if err != nil {
+		return KeySlot{}, err
+	}
+	if resp.Data.Ciphertext == "" {
+		return KeySlot{}, errors.New("vault returned no wrapped data key")
+	}
+	return w.slot(resp.Data.Ciphertext), nil
+}
+
+// UnwrapKey has the KMS decrypt the wrapped data key
+func (w *VaultTransitWrapper) UnwrapKey(slot KeySlot) ([]byte, error) {
+	if !w.Matches(slot) {
+		return nil, errors.New("key slot was not wrapped by vault key: " + w.config.KeyName)
+	}
+	resp, err := w.call("decrypt", map[string]interface{}{"ciphertext": string(slot.WrappedKey)})
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := base64.StdEncoding.DecodeString(resp.Data.Plaintext)
+	if err != nil || len(dataKey) != dataKeyLength {
+		return nil, errors.New("vault returned an invalid data key")
+	}
+	return dataKey, nil
+}
+
+// Matches reports whether the slot was wrapped by this transit key
+func (w *VaultTransitWrapper) Matches(slot KeySlot) bool {
+	return slot.Type == vaultSlotType && slot.KeyID == w.config.KeyName
+}
+
+func (w *VaultTransitWrapper) slot(ciphertext string) KeySlot {
+	return KeySlot{Type: vaultSlotType, KeyID: w.config.KeyName, WrappedKey: []byte(ciphertext)}
+}
+
+// call POSTs the body to the transit endpoint for our key and decodes the response
+func (w *VaultTransitWrapper) call(endpoint string, body map[string]interface{}) (*vaultResponse, error) {
+	reqBody, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	endpointURL := w.config.Address + "/v1/" + w.config.Mount + "/" + endpoint + "/" + url.PathEscape(w.config.KeyName)
+	req, err := http.NewRequest(http.MethodPost, endpointURL, bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, errors.New("vault request error: " + err.Error())
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Vault-Token", w.config.Token)
+	if w.config.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", w.config.Namespace)
+	}
+	httpResp, err := w.config.Client.Do(req)
+	if err != nil {
+		return nil, errors.New("vault request error: " + err.Error())
+	}
+	defer httpResp.Body.Close()
+	resp := &vaultResponse{}
+	err = json.NewDecoder(httpResp.Body).Decode(resp)
+	if httpResp.StatusCode != http.StatusOK {
+		if len(resp.Errors) > 0 {
+			return nil, errors.New("vault error: " + strings.Join(resp.Errors, ", "))
+		}
+		return nil, errors.New("vault error: " + httpResp.Status)
+	}
+	if err != nil {
+		return nil, errors.New("vault response decode error: " + err.Error())
+	}
+	return resp, nil
+}
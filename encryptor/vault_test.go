@@ -0,0 +1,233 @@
+package encryptor
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeTransit is a stand in for a Vault transit engine holding one key, it remembers the data
+// keys it hands out so it can decrypt them again
+type fakeTransit struct {
+	mu      sync.Mutex
+	keyName string
+	token   string
+	wrapped map[string]string
+	calls   map[string]int
+}
+
+func newFakeTransit(keyName, token string) (*fakeTransit, *httptest.Server) {
+	f := &fakeTransit{keyName: keyName, token: token, wrapped: map[string]string{}, calls: map[string]int{}}
+	return f, httptest.NewServer(f)
+}
+
+func (f *fakeTransit) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	endpoint := strings.TrimPrefix(req.URL.Path, "/v1/transit/")
+	f.calls[endpoint]++
+	if req.Method != http.MethodPost || req.Header.Get("Content-Type") != "application/json" {
+		f.fail(rw, http.StatusMethodNotAllowed, "unsupported request")
+		return
+	}
+	if req.Header.Get("X-Vault-Token") != f.token {
+		f.fail(rw, http.StatusForbidden, "permission denied")
+		return
+	}
+	var body struct {
+		Bits       int    `json:"bits"`
+		Plaintext  string `json:"plaintext"`
+		Ciphertext string `json:"ciphertext"`
+	}
+	err := json.NewDecoder(req.Body).Decode(&body)
+	if err != nil {
+		f.fail(rw, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	resp := vaultResponse{}
+	switch endpoint {
+	case "datakey/plaintext/" + f.keyName:
+		dataKey := make([]byte, body.Bits/8)
+		crand.Read(dataKey)
+		resp.Data.Plaintext = base64.StdEncoding.EncodeToString(dataKey)
+		resp.Data.Ciphertext = f.wrap(resp.Data.Plaintext)
+	case "encrypt/" + f.keyName:
+		resp.Data.Ciphertext = f.wrap(body.Plaintext)
+	case "decrypt/" + f.keyName:
+		plaintext, ok := f.wrapped[body.Ciphertext]
+		if !ok {
+			f.fail(rw, http.StatusBadRequest, "invalid ciphertext: unable to decrypt")
+			return
+		}
+		resp.Data.Plaintext = plaintext
+	default:
+		f.fail(rw, http.StatusNotFound, "no handler for route "+req.URL.Path)
+		return
+	}
+	json.NewEncoder(rw).Encode(resp)
+}
+
+func (f *fakeTransit) wrap(plaintext string) string {
+	ciphertext := fmt.Sprintf("vault:v1:%d", len(f.wrapped))
+	f.wrapped[ciphertext] = plaintext
+	return ciphertext
+}
+
+func (f *fakeTransit) fail(rw http.ResponseWriter, status int, message string) {
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(vaultResponse{Errors: []string{message}})
+}
+
+func (f *fakeTransit) called(endpoint string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[endpoint]
+}
+
+func newTestVaultWrapper(t *testing.T, address, keyName, token string) *VaultTransitWrapper {
+	w, err := NewVaultTransitWrapper(VaultTransitConfig{Address: address + "/", Token: token, KeyName: keyName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func TestVaultRoundTrip(t *testing.T) {
+	transit, server := newFakeTransit("filekey", "s.token")
+	defer server.Close()
+	w := newTestVaultWrapper(t, server.URL, "filekey", "s.token")
+	data := testData(2*chunkSize + 3)
+	var sealed bytes.Buffer
+	err := EncryptWithOptions(&sealed, bytes.NewReader(data), &Options{Wrapper: w})
+	if err != nil {
+		t.Fatal("encrypt:", err)
+	}
+	if transit.called("datakey/plaintext/filekey") != 1 || transit.called("encrypt/filekey") != 0 {
+		t.Fatalf("encrypt should ask for one data key, calls were %v", transit.calls)
+	}
+	var opened bytes.Buffer
+	_, err = DecryptWithOptions(&opened, bytes.NewReader(sealed.Bytes()), &Options{Wrapper: w})
+	if err != nil {
+		t.Fatal("decrypt:", err)
+	}
+	if transit.called("decrypt/filekey") != 1 {
+		t.Fatalf("decrypt should unwrap the data key once, calls were %v", transit.calls)
+	}
+	if !bytes.Equal(opened.Bytes(), data) {
+		t.Fatal("decrypted data differs")
+	}
+}
+
+func TestVaultWrapKey(t *testing.T) {
+	_, server := newFakeTransit("filekey", "s.token")
+	defer server.Close()
+	w := newTestVaultWrapper(t, server.URL, "filekey", "s.token")
+	dataKey := bytes.Repeat([]byte{7}, dataKeyLength)
+	slot, err := w.WrapKey(dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slot.Type != vaultSlotType || slot.KeyID != "filekey" || !w.Matches(slot) {
+		t.Fatalf("unexpected slot %+v", slot)
+	}
+	unwrapped, err := w.UnwrapKey(slot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unwrapped, dataKey) {
+		t.Fatal("unwrapped key differs")
+	}
+}
+
+func TestVaultErrors(t *testing.T) {
+	_, server := newFakeTransit("filekey", "s.token")
+	defer server.Close()
+	dataKey := make([]byte, dataKeyLength)
+
+	w := newTestVaultWrapper(t, server.URL, "filekey", "s.wrong")
+	_, _, err := w.GenerateDataKey()
+	if err == nil || err.Error() != "vault error: permission denied" {
+		t.Fatalf("wrong token: got %v", err)
+	}
+
+	w = newTestVaultWrapper(t, server.URL, "filekey", "s.token")
+	_, err = w.UnwrapKey(KeySlot{Type: vaultSlotType, KeyID: "filekey", WrappedKey: []byte("vault:v1:tampered")})
+	if err == nil || err.Error() != "vault error: invalid ciphertext: unable to decrypt" {
+		t.Fatalf("unknown ciphertext: got %v", err)
+	}
+
+	// a key the engine does not have is routed nowhere
+	w = newTestVaultWrapper(t, server.URL, "otherkey", "s.token")
+	_, err = w.WrapKey(dataKey)
+	if err == nil || !strings.HasPrefix(err.Error(), "vault error: no handler for route") {
+		t.Fatalf("missing key: got %v", err)
+	}
+
+	// without an errors list the HTTP status is reported
+	bare := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		http.Error(rw, "upstream down", http.StatusBadGateway)
+	}))
+	defer bare.Close()
+	w = newTestVaultWrapper(t, bare.URL, "filekey", "s.token")
+	_, err = w.WrapKey(dataKey)
+	if err == nil || err.Error() != "vault error: 502 Bad Gateway" {
+		t.Fatalf("bare error: got %v", err)
+	}
+}
+
+func TestVaultKeyNameMismatch(t *testing.T) {
+	transit, server := newFakeTransit("filekey", "s.token")
+	defer server.Close()
+	w := newTestVaultWrapper(t, server.URL, "filekey", "s.token")
+	slot, err := w.WrapKey(make([]byte, dataKeyLength))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := newTestVaultWrapper(t, server.URL, "otherkey", "s.token")
+	if other.Matches(slot) {
+		t.Fatal("a slot wrapped by filekey should not match otherkey")
+	}
+	if other.Matches(KeySlot{Type: pkcs11AESSlotType, KeyID: "filekey"}) || w.Matches(KeySlot{Type: pkcs11AESSlotType, KeyID: "filekey"}) {
+		t.Fatal("a slot of another type should not match")
+	}
+	_, err = other.UnwrapKey(slot)
+	if err == nil || err.Error() != "key slot was not wrapped by vault key: otherkey" {
+		t.Fatalf("got %v", err)
+	}
+	if transit.called("decrypt/otherkey") != 0 {
+		t.Fatal("a mismatched slot should not be sent to vault")
+	}
+}
+
+func TestVaultKeyNames(t *testing.T) {
+	for _, name := range []string{"../sys/seal", "a/b", "key?version=1", "key#x", "..", "a..b"} {
+		_, err := NewVaultTransitWrapper(VaultTransitConfig{Address: "https://vault.example.com", KeyName: name})
+		if err == nil || err.Error() != "invalid vault key name: "+name {
+			t.Fatalf("%q: got %v", name, err)
+		}
+	}
+
+	// other characters are escaped into a single path segment
+	for _, name := range []string{"file key", "key%2Fother", "k\u00e9y;1"} {
+		transit, server := newFakeTransit(name, "s.token")
+		w := newTestVaultWrapper(t, server.URL, name, "s.token")
+		_, slot, err := w.GenerateDataKey()
+		if err == nil {
+			_, err = w.UnwrapKey(slot)
+		}
+		server.Close()
+		if err != nil {
+			t.Fatalf("%q: %v", name, err)
+		}
+		if transit.called("datakey/plaintext/"+name) != 1 || transit.called("decrypt/"+name) != 1 {
+			t.Fatalf("%q: requests went to %v", name, transit.calls)
+		}
+	}
+}
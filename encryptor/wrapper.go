@@ -0,0 +1,337 @@
+package encryptor
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	// passwordSlotType is the key slot type for data keys wrapped with a scrypt derived key
+	passwordSlotType = "scrypt"
+	// batchPasswordSlotType slots wrap with an HKDF key derived from a scrypt key shared by a batch
+	batchPasswordSlotType = "scrypt-hkdf"
+	hkdfInfo              = "goCryptor file key"
+	// maxKDFMemory bounds the scrypt memory a header can ask for
+	maxKDFMemory   = 1 << 30
+	maxKDFParallel = 16
+)
+
+// KDFParams are the scrypt cost parameters for password slots
+type KDFParams struct {
+	N int `json:"n"`
+	R int `json:"r"`
+	P int `json:"p"`
+}
+
+// DefaultKDF is the scrypt cost used when none is given, and for slots that do not record one
+var DefaultKDF = KDFParams{N: 32768, R: 8, P: 1}
+
+// validate rejects parameters scrypt cannot use or that would take unreasonable memory
+func (p KDFParams) validate() error {
+	if p.N < 2 || p.N&(p.N-1) != 0 || p.R < 1 || p.P < 1 || p.P > maxKDFParallel || p.N > maxKDFMemory/(128*p.R) {
+		return errors.New("unsupported scrypt parameters")
+	}
+	return nil
+}
+
+// kdf returns the scrypt cost recorded in a password slot
+func (slot KeySlot) kdf() KDFParams {
+	if slot.KDF == nil {
+		return DefaultKDF
+	}
+	return *slot.KDF
+}
+
+// KeyWrapper protects the per file data key with a master key, such as a password, token or KMS key
+type KeyWrapper interface {
+	// WrapKey encrypts the data key and returns the key slot to store in the header
+	WrapKey(dataKey []byte) (KeySlot, error)
+	// UnwrapKey recovers the data key from a key slot
+	UnwrapKey(slot KeySlot) ([]byte, error)
+	// Matches reports whether the key slot was created by this wrapper
+	Matches(slot KeySlot) bool
+}
+
+// DataKeyGenerator is implemented by wrappers that issue data keys themselves, such as a KMS,
+// in which case the generated key is used instead of one from the local random source
+type DataKeyGenerator interface {
+	GenerateDataKey() ([]byte, KeySlot, error)
+}
+
+// KeyCache holds keys derived from passwords so repeated operations can skip the KDF
+type KeyCache interface {
+	Get(id string) ([]byte, bool)
+	Put(id string, key []byte)
+}
+
+// EncryptFileWithWrapper encrypts a file under a fresh data key protected by the wrapper,
+// writing it beside the input with the .gcx extension
+func EncryptFileWithWrapper(wrapper KeyWrapper, inputFile string) error {
+	return EncryptFileTo(wrapper, inputFile, EncryptedName(inputFile))
+}
+
+// EncryptFileTo encrypts inputFile and writes the result to outputFile, replacing it if it exists
+func EncryptFileTo(wrapper KeyWrapper, inputFile, outputFile string) error {
+	_, err := EncryptFileWithOptions(inputFile, outputFile, &Options{Wrapper: wrapper})
+	return err
+}
+
+// EncryptedName is the default output name for an encrypted file, the input name plus .gcx
+func EncryptedName(inputFile string) string {
+	return inputFile + ".gcx"
+}
+
+// DecryptFileWithWrapper decrypts a file whose data key was protected by the wrapper, writing it
+// beside the encrypted file. If overwrite is false and the file exists a number is added to the name.
+func DecryptFileWithWrapper(wrapper KeyWrapper, encryptedFile string, overwrite bool) error {
+	policy := ConflictOverwrite
+	if !overwrite {
+		policy = ConflictNumber
+	}
+	_, err := DecryptFileToDir(encryptedFile, filepath.Dir(encryptedFile), &Options{Wrapper: wrapper, Conflict: policy})
+	return err
+}
+
+// DecryptFileTo decrypts encryptedFile and writes the plaintext to outputFile, replacing it if it exists
+func DecryptFileTo(wrapper KeyWrapper, encryptedFile, outputFile string) error {
+	_, err := DecryptFileWithOptions(encryptedFile, outputFile, &Options{Wrapper: wrapper})
+	return err
+}
+
+// newWrappedDataKey asks the wrapper for a data key if it can generate one, otherwise creates one locally and wraps it
+func newWrappedDataKey(wrapper KeyWrapper, random io.Reader) ([]byte, KeySlot, error) {
+	if generator, ok := wrapper.(DataKeyGenerator); ok {
+		return generator.GenerateDataKey()
+	}
+	dataKey, err := newDataKey(random)
+	if err != nil {
+		return nil, KeySlot{}, err
+	}
+	slot, err := wrapper.WrapKey(dataKey)
+	if err != nil {
+		return nil, KeySlot{}, err
+	}
+	return dataKey, slot, nil
+}
+
+// unwrapDataKey tries each key slot the wrapper recognises until one unwraps
+func unwrapDataKey(wrapper KeyWrapper, h *header) ([]byte, error) {
+	err := errors.New("file has no key slot for this kind of key")
+	for _, slot := range h.KeySlots {
+		if !wrapper.Matches(slot) {
+			continue
+		}
+		var dataKey []byte
+		dataKey, err = wrapper.UnwrapKey(slot)
+		if err == nil {
+			return dataKey, nil
+		}
+	}
+	return nil, err
+}
+
+// PasswordWrapper wraps data keys with a key derived from a password using scrypt. In batch mode the
+// password is stretched once and each file's key is derived from it with HKDF over a per file salt.
+type PasswordWrapper struct {
+	password string
+	cache    KeyCache
+	// kdf is the scrypt cost for slots this wrapper writes, slots being read use their own
+	kdf    KDFParams
+	random io.Reader
+	// batchSalt is set in batch mode, it is the scrypt salt shared by every file wrapped
+	batchSalt []byte
+	// stretched memoizes scrypt results by salt for the life of the wrapper, stretching has a channel
+	// for each salt being stretched that is closed once it is done, so concurrent files sharing a salt
+	// run scrypt once
+	mu         sync.Mutex
+	stretched  map[string][]byte
+	stretching map[string]chan struct{}
+}
+
+// NewPasswordWrapper creates a wrapper for the password, cache may be nil
+func NewPasswordWrapper(password string, cache KeyCache) *PasswordWrapper {
+	return newPasswordWrapper(password, cache, DefaultKDF, rand.Reader)
+}
+
+func newPasswordWrapper(password string, cache KeyCache, kdf KDFParams, random io.Reader) *PasswordWrapper {
+	return &PasswordWrapper{
+		password:   password,
+		cache:      cache,
+		kdf:        kdf,
+		random:     random,
+		stretched:  make(map[string][]byte),
+		stretching: make(map[string]chan struct{}),
+	}
+}
+
+// NewBatchPasswordWrapper runs scrypt once for a whole batch of files, every file still records both
+// salts so it can be decrypted on its own
+func NewBatchPasswordWrapper(password string, cache KeyCache) (*PasswordWrapper, error) {
+	w := NewPasswordWrapper(password, cache)
+	w.batchSalt = make([]byte, 32)
+	_, err := io.ReadFull(w.random, w.batchSalt)
+	if err != nil {
+		return nil, errors.New("salt generation failed: " + err.Error())
+	}
+	_, err = w.stretch(w.batchSalt, w.kdf)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// WrapKey seals the data key with a key derived from the password and a fresh salt
+func (w *PasswordWrapper) WrapKey(dataKey []byte) (KeySlot, error) {
+	// Generating salt from random reader
+	salt := make([]byte, 32)
+	_, err := io.ReadFull(w.random, salt)
+	if err != nil {
+		return KeySlot{}, errors.New("salt generation failed: " + err.Error())
+	}
+	slot := KeySlot{Type: passwordSlotType, Salt: salt}
+	if w.batchSalt != nil {
+		slot = KeySlot{Type: batchPasswordSlotType, Salt: w.batchSalt, FileSalt: salt}
+	}
+	// the default cost is left out so headers stay the same as before it could be changed
+	if w.kdf != DefaultKDF {
+		kdf := w.kdf
+		slot.KDF = &kdf
+	}
+	key, err := w.slotKey(slot)
+	if err != nil {
+		return KeySlot{}, err
+	}
+	slot.WrappedKey, err = sealKey(w.random, key, dataKey)
+	if err != nil {
+		return KeySlot{}, err
+	}
+	w.remember(slot.Salt, slot.kdf())
+	return slot, nil
+}
+
+// UnwrapKey derives the key for the slot's salts and opens the data key
+func (w *PasswordWrapper) UnwrapKey(slot KeySlot) ([]byte, error) {
+	key, err := w.slotKey(slot)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := openKey(key, slot.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	w.remember(slot.Salt, slot.kdf())
+	return dataKey, nil
+}
+
+// Matches reports whether the slot is a password slot
+func (w *PasswordWrapper) Matches(slot KeySlot) bool {
+	return slot.Type == passwordSlotType || slot.Type == batchPasswordSlotType
+}
+
+// slotKey derives the key that wraps the data key in a password slot
+func (w *PasswordWrapper) slotKey(slot KeySlot) ([]byte, error) {
+	kdf := slot.kdf()
+	err := kdf.validate()
+	if err != nil {
+		return nil, err
+	}
+	stretched, err := w.stretch(slot.Salt, kdf)
+	if err != nil {
+		return nil, err
+	}
+	if slot.Type == passwordSlotType {
+		return stretched, nil
+	}
+	key := make([]byte, 32)
+	_, err = io.ReadFull(hkdf.New(sha256.New, stretched, slot.FileSalt, []byte(hkdfInfo)), key)
+	if err != nil {
+		return nil, errors.New("Unable to derive file key: " + err.Error())
+	}
+	return key, nil
+}
+
+// stretch runs scrypt over the password and salt, unless this wrapper or the cache already has
+func (w *PasswordWrapper) stretch(salt []byte, kdf KDFParams) ([]byte, error) {
+	id := stretchID(salt, kdf)
+	for {
+		w.mu.Lock()
+		key, ok := w.stretched[id]
+		wait, busy := w.stretching[id]
+		if !ok && !busy {
+			w.stretching[id] = make(chan struct{})
+		}
+		w.mu.Unlock()
+		if ok {
+			return key, nil
+		}
+		if !busy {
+			break
+		}
+		// another file is stretching the same salt, use its result or try again if it failed
+		<-wait
+	}
+	defer func() {
+		w.mu.Lock()
+		close(w.stretching[id])
+		delete(w.stretching, id)
+		w.mu.Unlock()
+	}()
+	if w.cache != nil {
+		if key, ok := w.cache.Get(w.cacheID(salt, kdf)); ok && len(key) == 32 {
+			w.memoize(salt, kdf, key)
+			return key, nil
+		}
+	}
+	// use the scrypt library to generate a 32 bit key from the password
+	key, err := scrypt.Key([]byte(w.password), salt, kdf.N, kdf.R, kdf.P, 32)
+	if err != nil {
+		return nil, errors.New("Unable to create key from password: " + err.Error())
+	}
+	w.memoize(salt, kdf, key)
+	return key, nil
+}
+
+func (w *PasswordWrapper) memoize(salt []byte, kdf KDFParams, key []byte) {
+	w.mu.Lock()
+	w.stretched[stretchID(salt, kdf)] = key
+	w.mu.Unlock()
+}
+
+// remember hands a stretched key that has just proved correct to the cache
+func (w *PasswordWrapper) remember(salt []byte, kdf KDFParams) {
+	if w.cache == nil {
+		return
+	}
+	w.mu.Lock()
+	key, ok := w.stretched[stretchID(salt, kdf)]
+	w.mu.Unlock()
+	if ok {
+		w.cache.Put(w.cacheID(salt, kdf), key)
+	}
+}
+
+// stretchID keys the memoized scrypt results by cost and salt
+func stretchID(salt []byte, kdf KDFParams) string {
+	return fmt.Sprintf("%d/%d/%d/%s", kdf.N, kdf.R, kdf.P, salt)
+}
+
+// cacheID names a derived key by its KDF, salt and password, so a wrong password never hits the cache
+func (w *PasswordWrapper) cacheID(salt []byte, kdf KDFParams) string {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write([]byte(w.password))
+	// ids for the default cost are unchanged from before the cost could be set
+	if kdf != DefaultKDF {
+		fmt.Fprintf(mac, "/%d/%d/%d", kdf.N, kdf.R, kdf.P)
+	}
+	return passwordSlotType + ":" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,10 @@
+// +build !linux,!darwin,!freebsd,!netbsd
+
+package encryptor
+
+// readXattrs finds no extended attributes where they are not supported
+func readXattrs(path string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+func writeXattrs(path string, xattrs map[string][]byte) {}
@@ -0,0 +1,55 @@
+// +build linux darwin freebsd netbsd
+
+package encryptor
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestXattrsRoundTrip(t *testing.T) {
+	dir, plain := attrsFile(t, 0644, time.Now())
+	err := unix.Setxattr(plain, "user.gocryptor.test", []byte("kept"), 0)
+	if err != nil {
+		t.Skip("the temp folder does not take user extended attributes: " + err.Error())
+	}
+	attrs, err := ReadFileAttrs(plain, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(attrs.Xattrs["user.gocryptor.test"]) != "kept" {
+		t.Fatalf("read %v", attrs.Xattrs)
+	}
+	sealed, err := EncryptFileContext(context.Background(), plain, plain+".gcx", &Options{Password: "pw", KDF: testKDF, Xattrs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// extended attributes are only restored when asked for
+	for _, xattrs := range []bool{false, true} {
+		output := filepath.Join(dir, "out.txt")
+		os.Remove(output)
+		_, err = DecryptFileContext(context.Background(), sealed, output, &Options{Password: "pw", Xattrs: xattrs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		value := make([]byte, 16)
+		n, err := unix.Getxattr(output, "user.gocryptor.test", value)
+		if xattrs && (err != nil || string(value[:n]) != "kept") {
+			t.Fatalf("restored %q, %v", value[:n], err)
+		}
+		if !xattrs && err == nil {
+			t.Fatal("restored without being asked for")
+		}
+	}
+
+	// without Xattrs none are read or stored
+	attrs, err = ReadFileAttrs(plain, false, false)
+	if err != nil || attrs.Xattrs != nil {
+		t.Fatalf("read %v, %v without asking", attrs, err)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ignoreFileName is read from every folder that is walked, it holds gitignore style exclude patterns
+const ignoreFileName = ".gcxignore"
+
+// filterRule is one gitignore style pattern
+type filterRule struct {
+	// base is the folder, relative to the walk root and slash separated, that the pattern is relative to
+	base     string
+	segments []string
+	negate   bool
+	dirOnly  bool
+	// anchored patterns contain a slash and match from base, others match a name at any depth
+	anchored bool
+}
+
+// parseRule parses a line of a .gcxignore file or a pattern from the command line, blank lines
+// and comments return false
+func parseRule(line, base string) (filterRule, bool) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return filterRule{}, false
+	}
+	rule := filterRule{base: base}
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	}
+	// a leading backslash escapes a literal ! or #
+	line = strings.TrimPrefix(line, "\\")
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if strings.Contains(line, "/") {
+		rule.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	if line == "" {
+		return filterRule{}, false
+	}
+	rule.segments = strings.Split(line, "/")
+	return rule, true
+}
+
+// match reports whether the slash separated path, relative to the walk root, matches the rule
+func (r filterRule) match(rel string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	if r.base != "" {
+		if !strings.HasPrefix(rel, r.base+"/") {
+			return false
+		}
+		rel = rel[len(r.base)+1:]
+	}
+	if !r.anchored {
+		ok, _ := path.Match(r.segments[0], path.Base(rel))
+		return ok
+	}
+	return matchSegments(r.segments, strings.Split(rel, "/"))
+}
+
+// matchSegments matches path segments against pattern segments, ** matches any number of folders
+func matchSegments(pattern, parts []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(parts); i++ {
+				if matchSegments(pattern[1:], parts[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(parts) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], parts[0]); !ok {
+			return false
+		}
+		pattern, parts = pattern[1:], parts[1:]
+	}
+	return len(parts) == 0
+}
+
+// fileFilter decides which files a folder walk visits from include and exclude patterns and the
+// .gcxignore files found along the way
+type fileFilter struct {
+	includes []filterRule
+	excludes []filterRule
+	// ignoreFiles holds the rules read from each folder's .gcxignore, by relative folder
+	ignoreFiles map[string][]filterRule
+}
+
+// newFileFilter creates a filter from command line or settings patterns. When there are include
+// patterns a file must match one of them, exclude patterns win over .gcxignore files.
+func newFileFilter(includes, excludes []string) *fileFilter {
+	f := &fileFilter{ignoreFiles: make(map[string][]filterRule)}
+	for _, pattern := range includes {
+		if rule, ok := parseRule(pattern, ""); ok {
+			f.includes = append(f.includes, rule)
+		}
+	}
+	for _, pattern := range excludes {
+		if rule, ok := parseRule(pattern, ""); ok {
+			f.excludes = append(f.excludes, rule)
+		}
+	}
+	return f
+}
+
+// loadIgnoreFile reads the .gcxignore in a folder if there is one
+func (f *fileFilter) loadIgnoreFile(rel, dir string) error {
+	file, err := os.Open(filepath.Join(dir, ignoreFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var rules []filterRule
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if rule, ok := parseRule(scanner.Text(), rel); ok {
+			rules = append(rules, rule)
+		}
+	}
+	f.ignoreFiles[rel] = rules
+	return scanner.Err()
+}
+
+// excluded applies the rules from the root down, like gitignore the last matching rule wins
+func (f *fileFilter) excluded(rel string, isDir bool) bool {
+	excluded := false
+	apply := func(rules []filterRule) {
+		for _, rule := range rules {
+			if rule.match(rel, isDir) {
+				excluded = !rule.negate
+			}
+		}
+	}
+	apply(f.ignoreFiles[""])
+	for i := 0; i < len(rel); i++ {
+		if rel[i] == '/' {
+			apply(f.ignoreFiles[rel[:i]])
+		}
+	}
+	apply(f.excludes)
+	return excluded
+}
+
+// included reports whether a file, or one of the folders it is in, matches the include patterns, so
+// reports/ includes everything below a reports folder. Everything is included when there are none.
+func (f *fileFilter) included(rel string) bool {
+	if len(f.includes) == 0 {
+		return true
+	}
+	for _, rule := range f.includes {
+		if rule.match(rel, false) {
+			return true
+		}
+		for i := 0; i < len(rel); i++ {
+			if rel[i] == '/' && rule.match(rel[:i], true) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// splitPatterns splits a comma separated list of patterns from the settings field
+func splitPatterns(list string) []string {
+	var patterns []string
+	for _, pattern := range strings.Split(list, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		line string
+		base string
+		ok   bool
+		want filterRule
+	}{
+		{line: "", ok: false},
+		{line: "   ", ok: false},
+		{line: "# comment", ok: false},
+		{line: "/", ok: false},
+		{line: "*.tmp", ok: true, want: filterRule{segments: []string{"*.tmp"}}},
+		{line: "*.tmp \t\r", ok: true, want: filterRule{segments: []string{"*.tmp"}}},
+		{line: "build/", ok: true, want: filterRule{segments: []string{"build"}, dirOnly: true}},
+		{line: "!keep.txt", ok: true, want: filterRule{segments: []string{"keep.txt"}, negate: true}},
+		{line: "\\#literal", ok: true, want: filterRule{segments: []string{"#literal"}}},
+		{line: "\\!literal", ok: true, want: filterRule{segments: []string{"!literal"}}},
+		{line: "/root.txt", ok: true, want: filterRule{segments: []string{"root.txt"}, anchored: true}},
+		{line: "docs/*.md", ok: true, want: filterRule{segments: []string{"docs", "*.md"}, anchored: true}},
+		{line: "a/**/b/", ok: true, want: filterRule{segments: []string{"a", "**", "b"}, anchored: true, dirOnly: true}},
+		{line: "*.log", base: "sub/dir", ok: true, want: filterRule{base: "sub/dir", segments: []string{"*.log"}}},
+	}
+	for _, test := range tests {
+		rule, ok := parseRule(test.line, test.base)
+		if ok != test.ok {
+			t.Errorf("parseRule(%q) ok = %v, want %v", test.line, ok, test.ok)
+			continue
+		}
+		if ok && !reflect.DeepEqual(rule, test.want) {
+			t.Errorf("parseRule(%q) = %+v, want %+v", test.line, rule, test.want)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		base    string
+		rel     string
+		isDir   bool
+		want    bool
+	}{
+		{pattern: "*.tmp", rel: "a.tmp", want: true},
+		{pattern: "*.tmp", rel: "deep/down/a.tmp", want: true},
+		{pattern: "*.tmp", rel: "a.txt", want: false},
+		{pattern: "build/", rel: "build", isDir: true, want: true},
+		{pattern: "build/", rel: "src/build", isDir: true, want: true},
+		{pattern: "build/", rel: "build", isDir: false, want: false},
+		{pattern: "/root.txt", rel: "root.txt", want: true},
+		{pattern: "/root.txt", rel: "sub/root.txt", want: false},
+		{pattern: "docs/*.md", rel: "docs/a.md", want: true},
+		{pattern: "docs/*.md", rel: "docs/sub/a.md", want: false},
+		{pattern: "docs/*.md", rel: "other/docs/a.md", want: false},
+		{pattern: "docs/**/*.md", rel: "docs/a/b/c.md", want: true},
+		{pattern: "**/cache", rel: "x/y/cache", isDir: true, want: true},
+		{pattern: "*.log", base: "sub", rel: "sub/a.log", want: true},
+		{pattern: "*.log", base: "sub", rel: "other/a.log", want: false},
+		{pattern: "*.log", base: "sub", rel: "subway/a.log", want: false},
+		{pattern: "/a.log", base: "sub", rel: "sub/a.log", want: true},
+		{pattern: "/a.log", base: "sub", rel: "sub/x/a.log", want: false},
+	}
+	for _, test := range tests {
+		rule, ok := parseRule(test.pattern, test.base)
+		if !ok {
+			t.Fatalf("parseRule(%q) failed", test.pattern)
+		}
+		if got := rule.match(test.rel, test.isDir); got != test.want {
+			t.Errorf("%q in %q match(%q, %v) = %v, want %v", test.pattern, test.base, test.rel, test.isDir, got, test.want)
+		}
+	}
+}
+
+func TestMatchSegments(t *testing.T) {
+	tests := []struct {
+		pattern []string
+		parts   []string
+		want    bool
+	}{
+		{[]string{"a"}, []string{"a"}, true},
+		{[]string{"a"}, []string{"b"}, false},
+		{[]string{"a"}, []string{"a", "b"}, false},
+		{[]string{"a", "b"}, []string{"a"}, false},
+		{[]string{"a", "*"}, []string{"a", "b"}, true},
+		{[]string{"**"}, []string{}, true},
+		{[]string{"**"}, []string{"a", "b", "c"}, true},
+		{[]string{"**", "c"}, []string{"c"}, true},
+		{[]string{"**", "c"}, []string{"a", "b", "c"}, true},
+		{[]string{"**", "c"}, []string{"a", "b", "d"}, false},
+		{[]string{"a", "**", "c"}, []string{"a", "c"}, true},
+		{[]string{"a", "**", "c"}, []string{"a", "x", "y", "c"}, true},
+		{[]string{"a", "**", "c"}, []string{"b", "x", "c"}, false},
+		{[]string{"a", "**"}, []string{"a", "x", "y"}, true},
+		{[]string{"[ab]", "?.go"}, []string{"b", "x.go"}, true},
+	}
+	for _, test := range tests {
+		if got := matchSegments(test.pattern, test.parts); got != test.want {
+			t.Errorf("matchSegments(%q, %q) = %v, want %v", test.pattern, test.parts, got, test.want)
+		}
+	}
+}
+
+func TestIncluded(t *testing.T) {
+	tests := []struct {
+		includes []string
+		rel      string
+		want     bool
+	}{
+		{nil, "anything.bin", true},
+		{[]string{"*.docx"}, "a/b/report.docx", true},
+		{[]string{"*.docx"}, "a/b/report.pdf", false},
+		{[]string{"reports/"}, "reports/a.pdf", true},
+		{[]string{"reports/"}, "x/reports/y/a.pdf", true},
+		{[]string{"reports/"}, "reports", false},
+		{[]string{"reports/"}, "other/a.pdf", false},
+		{[]string{"reports"}, "reports/a.pdf", true},
+		{[]string{"/reports/"}, "x/reports/a.pdf", false},
+		{[]string{"docs/2020/"}, "docs/2020/q1/a.txt", true},
+		{[]string{"docs/2020/"}, "docs/2021/a.txt", false},
+	}
+	for _, test := range tests {
+		f := newFileFilter(test.includes, nil)
+		if got := f.included(test.rel); got != test.want {
+			t.Errorf("includes %q: included(%q) = %v, want %v", test.includes, test.rel, got, test.want)
+		}
+	}
+}
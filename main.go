@@ -1,21 +1,27 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/deranjer/gocryptor/agent"
 	"github.com/deranjer/gocryptor/encryptor"
 	"github.com/deranjer/gocryptor/resources"
-	"github.com/integrii/flaggy"
 	"github.com/sqweek/dialog"
 
 	"fyne.io/fyne"
 	"fyne.io/fyne/app"
+	fynedialog "fyne.io/fyne/dialog"
 	"fyne.io/fyne/driver/desktop"
 	"fyne.io/fyne/layout"
 	"fyne.io/fyne/widget"
@@ -28,11 +34,40 @@ type goCryptorUI struct {
 	passConfirmEntry *widget.Entry
 	fileName         string
 	fileNameLabel    *widget.Label
-	overwriteFile    bool
+	conflict         encryptor.ConflictPolicy
 	logger           *log.Logger
+	agentClient      *agent.Client
+	// includeEntry and excludeEntry hold comma separated patterns filtering folder walks
+	includeEntry *widget.Entry
+	excludeEntry *widget.Entry
+	// afterEncrypt and afterDecrypt are what happens to the input once its output is written
+	afterEncrypt encryptor.Disposition
+	afterDecrypt encryptor.Disposition
+	// dryRun shows what encrypt or decrypt would do instead of doing it
+	dryRun bool
+	// rememberPassword hands the password itself to the agent once it has worked, otherwise the
+	// agent only caches the keys derived from it
+	rememberPassword bool
+	window           fyne.Window
+	// askMu stops workers asking about several existing files at once
+	askMu sync.Mutex
+	// progressBar, currentLabel and timeLabel follow the job running in the background, the action
+	// buttons are disabled while it runs
+	progressBar   *widget.ProgressBar
+	currentLabel  *widget.Label
+	timeLabel     *widget.Label
+	actionButtons []*widget.Button
+	jobMu         sync.Mutex
+	job           *job
+	// queue lists the files of the last encrypt or decrypt and how each went
+	queue *batchQueue
 }
 
 func (ui *goCryptorUI) encryptFile() {
+	if ui.dryRun {
+		ui.preview("encrypt")
+		return
+	}
 	err := ui.validateInformation()
 	if err != nil {
 		return
@@ -44,45 +79,32 @@ func (ui *goCryptorUI) encryptFile() {
 		go ui.statusFade(3)
 		return
 	}
-	if isDir {
-		err = filepath.Walk(ui.fileName, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-			if info.IsDir() {
-				return nil
-			}
-			err = encryptor.EncryptFile(ui.passwordEntry.Text, path)
+	ui.startJob("encrypt", ui.encryptWork(ui.passwordEntry.Text, isDir))
+}
+
+// encryptWork returns the job encrypting the files of its options with password
+func (ui *goCryptorUI) encryptWork(password string, isDir bool) func(ctx context.Context, opts *options) {
+	return func(ctx context.Context, opts *options) {
+		var wrapper encryptor.KeyWrapper = encryptor.NewPasswordWrapper(password, ui.agentClient)
+		if isDir {
+			// stretch the password once for the whole folder, each file gets its own key from it
+			batchWrapper, err := encryptor.NewBatchPasswordWrapper(password, ui.agentClient)
 			if err != nil {
-				ui.logger.Printf("Error encrypting file: %s err: %s", path, err)
-				ui.statusLabel.SetText("Error encrypting file: " + err.Error())
-				return nil
+				ui.logger.Println("Error deriving key: ", err)
+				ui.statusLabel.SetText("Error deriving key: " + err.Error())
+				return
 			}
-			ui.logger.Println("Success encrypting file: ", path)
-			return nil
-		})
-		if err != nil {
-			ui.logger.Println("Walk dir err: ", err)
-			return
+			wrapper = batchWrapper
 		}
-	} else {
-		err = encryptor.EncryptFile(ui.passwordEntry.Text, ui.fileName)
-		if err != nil {
-			ui.logger.Printf("Error encrypting file: %s err: %s", ui.fileName, err)
-			ui.statusLabel.SetText("Error encrypting file: " + err.Error())
-			return
-		}
-		ui.logger.Println("Success encrypting file: ", ui.fileName)
+		ui.finishFiles("encrypt", password, ui.runFiles(ctx, opts, wrapper, isDir))
 	}
-	ui.statusLabel.SetText("Success encrypting file(s)!")
-	go ui.statusFade(5)
-	ui.passwordEntry.SetText("")
-	ui.passConfirmEntry.SetText("")
-	ui.fileName = ""
-	ui.fileNameLabel.SetText("File Path: ")
 }
 
 func (ui *goCryptorUI) decryptFile() {
+	if ui.dryRun {
+		ui.preview("decrypt")
+		return
+	}
 	err := ui.validateInformation()
 	if err != nil {
 		return
@@ -93,46 +115,487 @@ func (ui *goCryptorUI) decryptFile() {
 		go ui.statusFade(3)
 		return
 	}
-	if isDir {
-		err = filepath.Walk(ui.fileName, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-			if info.IsDir() {
-				return nil
-			}
-			if filepath.Ext(path) != ".gcx" {
-				ui.logger.Println("not the expected encryption extension...")
-				return nil
-			}
-			ui.logger.Println("Working on file: ", path)
-			err = encryptor.DecryptFile(ui.passwordEntry.Text, path, ui.overwriteFile)
-			if err != nil {
-				ui.logger.Println("error decrypting file!", err)
-				ui.statusLabel.SetText("Error decrypting file: " + err.Error())
-				return nil
+	ui.startJob("decrypt", ui.decryptWork(ui.passwordEntry.Text, isDir))
+}
+
+// decryptWork returns the job decrypting the files of its options with password
+func (ui *goCryptorUI) decryptWork(password string, isDir bool) func(ctx context.Context, opts *options) {
+	return func(ctx context.Context, opts *options) {
+		// share one wrapper so files from the same batch only run scrypt once
+		wrapper := encryptor.NewPasswordWrapper(password, ui.agentClient)
+		ui.finishFiles("decrypt", password, ui.runFiles(ctx, opts, wrapper, isDir))
+	}
+}
+
+// retryFailed runs the action of the queue again over its files that failed or were never reached,
+// with the password and settings as they are now
+func (ui *goCryptorUI) retryFailed() {
+	action, root, isDir, paths := ui.queue.unfinished()
+	if len(paths) == 0 {
+		ui.statusLabel.SetText("No failed files to retry")
+		go ui.statusFade(3)
+		return
+	}
+	if action == "encrypt" {
+		err := ui.validateInformation()
+		if err != nil {
+			return
+		}
+	} else if ui.passwordEntry.Text == "" {
+		ui.statusLabel.SetText("Password cannot be empty!")
+		go ui.statusFade(3)
+		return
+	}
+	work := ui.decryptWork(ui.passwordEntry.Text, isDir)
+	if action == "encrypt" {
+		work = ui.encryptWork(ui.passwordEntry.Text, isDir)
+	}
+	ui.logger.Printf("Retrying %s of %d file(s)", action, len(paths))
+	ui.startJob(action, func(ctx context.Context, opts *options) {
+		opts.fileName, opts.paths = root, paths
+		work(ctx, opts)
+	})
+}
+
+// exportQueue saves the queue as a text file, one file per line with its status and any reason
+func (ui *goCryptorUI) exportQueue() {
+	fileName, err := dialog.File().Title("Export Queue").Filter("Text files", "txt").Save()
+	if err == dialog.ErrCancelled {
+		return
+	}
+	if err == nil {
+		err = ui.queue.export(fileName)
+	}
+	if err != nil {
+		ui.logger.Println("Export queue err: ", err)
+		ui.statusLabel.SetText("Error exporting queue: " + err.Error())
+		go ui.statusFade(4)
+		return
+	}
+	ui.statusLabel.SetText("Queue exported to " + filepath.Base(fileName))
+	go ui.statusFade(3)
+}
+
+// batchOutcome sums up a run of encrypt or decrypt in the window
+type batchOutcome struct {
+	succeeded int
+	failed    int
+	lastError string
+	// warned counts the files written whose input could not be disposed of
+	warned      int
+	lastWarning string
+	// err is a folder that could not be walked, or the cancellation
+	err error
+}
+
+// runFiles processes the file or folder, logging each file and following it in the queue, a file
+// skipped because its output exists is not an error
+func (ui *goCryptorUI) runFiles(ctx context.Context, opts *options, wrapper encryptor.KeyWrapper, isDir bool) batchOutcome {
+	var outcome batchOutcome
+	retry := opts.paths != nil
+	opts.queued = func(paths []string) {
+		ui.queue.start(opts.command, opts.fileName, isDir, paths, retry)
+	}
+	outcome.err = runBatch(ctx, opts, wrapper, isDir, func(res fileResult) {
+		ui.queue.record(res)
+		switch {
+		case res.Skipped != "":
+			ui.logger.Printf("Skipped file: %s %s", res.Path, res.Skipped)
+		case res.Error != "":
+			ui.logger.Printf("Error %s file: %s err: %s", opts.command, res.Path, res.Error)
+			outcome.failed++
+			outcome.lastError = res.Error
+		default:
+			ui.logger.Printf("Success %s file: %s", opts.command, res.Path)
+			outcome.succeeded++
+			if res.Warning != "" {
+				ui.logger.Printf("Warning for file: %s: %s", res.Path, res.Warning)
+				outcome.warned++
+				outcome.lastWarning = res.Warning
 			}
-			return nil
+		}
+	})
+	if outcome.err != nil {
+		ui.logger.Println("Walk dir err: ", outcome.err)
+	}
+	return outcome
+}
+
+// finishFiles reports how a run went, once everything has worked the password is handed to the agent
+// if the user asked for that, and the form is cleared for the next file
+func (ui *goCryptorUI) finishFiles(action, password string, outcome batchOutcome) {
+	switch {
+	case outcome.err == context.Canceled:
+		ui.statusLabel.SetText(fmt.Sprintf("Cancelled after %d file(s), unfinished files were removed", outcome.succeeded))
+	case outcome.err != nil:
+		ui.statusLabel.SetText("Error: " + outcome.err.Error())
+	case outcome.failed > 0:
+		ui.statusLabel.SetText(fmt.Sprintf("Error %sing %d file(s): %s", action, outcome.failed, outcome.lastError))
+	default:
+		if outcome.warned > 0 {
+			ui.statusLabel.SetText(fmt.Sprintf("Success %sing file(s), %d input(s) were left in place: %s", action, outcome.warned, outcome.lastWarning))
+		} else {
+			ui.statusLabel.SetText("Success " + action + "ing file(s)!")
+			go ui.statusFade(5)
+		}
+		if ui.rememberPassword {
+			ui.agentClient.Put(agent.PasswordName, []byte(password))
+		}
+		ui.passwordEntry.SetText("")
+		ui.passConfirmEntry.SetText("")
+		ui.fileName = ""
+		ui.fileNameLabel.SetText("File Path: ")
+	}
+}
+
+// preview lists what the action would do to each file, no password is needed since nothing is decrypted.
+// Walking a large folder and reading every header takes a while, so it runs as a job like verify.
+func (ui *goCryptorUI) preview(action string) {
+	isDir, err := validateFileName(ui.fileName)
+	if err != nil {
+		ui.statusLabel.SetText("Error: " + err.Error())
+		go ui.statusFade(3)
+		return
+	}
+	ui.startJob(action, func(ctx context.Context, opts *options) {
+		var listing bytes.Buffer
+		report := newReporter(false, &listing, action)
+		report.errOut = &listing
+		runDryRun(ctx, opts, isDir, report)
+		if ctx.Err() != nil {
+			listing.WriteString("Cancelled, only the files above were looked at\n")
+		}
+		if listing.Len() == 0 {
+			listing.WriteString("Nothing to " + action)
+		}
+		ui.showListing("Dry run: "+action, listing.String())
+	})
+}
+
+// verifyFiles checks that the file, or every encrypted file in the folder, decrypts with the entered
+// password without writing anything, then lists which are intact, corrupt or need another password
+func (ui *goCryptorUI) verifyFiles() {
+	if ui.dryRun {
+		ui.preview("verify")
+		return
+	}
+	// nothing is encrypted so the password does not need confirming
+	if ui.passwordEntry.Text == "" {
+		ui.statusLabel.SetText("Password cannot be empty!")
+		go ui.statusFade(3)
+		return
+	}
+	isDir, err := validateFileName(ui.fileName)
+	if err != nil {
+		ui.statusLabel.SetText("Error: " + err.Error())
+		go ui.statusFade(3)
+		return
+	}
+	password := ui.passwordEntry.Text
+	ui.startJob("verify", func(ctx context.Context, opts *options) {
+		var listing bytes.Buffer
+		report := newReporter(false, &listing, "verify")
+		report.errOut = &listing
+		code := exitOK
+		err := runBatch(ctx, opts, encryptor.NewPasswordWrapper(password, ui.agentClient), isDir, func(res fileResult) {
+			code = worseExitCode(code, res.Code)
+			report.file(res)
 		})
-		if err != nil {
+		if err == context.Canceled {
+			listing.WriteString("Cancelled, the files above were checked\n")
+		} else if err != nil {
 			ui.logger.Println("Walk dir err: ", err)
+			report.walkError(err)
 		}
-	} else {
-		err = encryptor.DecryptFile(ui.passwordEntry.Text, ui.fileName, ui.overwriteFile)
-		if err != nil {
-			ui.logger.Println("error decrypting file! ", err)
-			ui.statusLabel.SetText("Error decrypting file: " + err.Error())
+		report.finish(code)
+		if report.summary.Files == 0 && err == nil {
+			listing.WriteString("No encrypted files found\n")
+		}
+		if code == exitOK && err == nil && ui.rememberPassword {
+			ui.agentClient.Put(agent.PasswordName, []byte(password))
+		}
+		ui.showListing("Verify", listing.String())
+	})
+}
+
+// job is the encrypt, decrypt or verify running in the background
+type job struct {
+	cancel context.CancelFunc
+	start  time.Time
+	// done is closed once the job has returned and cleaned up after itself
+	done chan struct{}
+	// progress is the latest report from the workers, it is shown a few times a second
+	mu       sync.Mutex
+	progress batchProgress
+}
+
+func (j *job) update(p batchProgress) {
+	j.mu.Lock()
+	j.progress = p
+	j.mu.Unlock()
+}
+
+func (j *job) latest() batchProgress {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.progress
+}
+
+// startJob runs work on its own goroutine so the window stays responsive, with the settings as they
+// are now. The action buttons are disabled and the progress shown until it returns, and Cancel
+// stops it through the context.
+func (ui *goCryptorUI) startJob(action string, work func(ctx context.Context, opts *options)) {
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &job{cancel: cancel, start: time.Now(), done: make(chan struct{})}
+	opts := ui.batchOptions(action)
+	opts.progress = j.update
+	ui.jobMu.Lock()
+	ui.job = j
+	ui.jobMu.Unlock()
+	for _, button := range ui.actionButtons {
+		button.Disable()
+	}
+	ui.progressBar.SetValue(0)
+	ui.currentLabel.SetText("Working...")
+	ui.timeLabel.SetText("")
+	go ui.followJob(j, j.done)
+	go func() {
+		work(ctx, opts)
+		close(j.done)
+		cancel()
+		ui.jobMu.Lock()
+		ui.job = nil
+		ui.jobMu.Unlock()
+		for _, button := range ui.actionButtons {
+			button.Enable()
+		}
+	}()
+}
+
+// followJob shows the progress of the job until done is closed
+func (ui *goCryptorUI) followJob(j *job, done <-chan struct{}) {
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ui.showProgress(j)
+		case <-done:
+			ui.showProgress(j)
+			ui.currentLabel.SetText("")
 			return
 		}
-		ui.logger.Println("Decrypted file: ", ui.fileName)
 	}
+}
+
+// showProgress updates the progress bar, the current file and the elapsed and remaining time
+func (ui *goCryptorUI) showProgress(j *job) {
+	p := j.latest()
+	elapsed := time.Since(j.start)
+	if p.Bytes > 0 {
+		ui.progressBar.SetValue(float64(p.BytesDone) / float64(p.Bytes))
+	}
+	if p.File != "" {
+		ui.currentLabel.SetText(fmt.Sprintf("%d/%d: %s", p.FilesDone, p.Files, filepath.Base(p.File)))
+	}
+	times := "Elapsed " + elapsed.Round(time.Second).String()
+	if p.BytesDone > 0 && p.BytesDone < p.Bytes {
+		remaining := time.Duration(float64(elapsed) * float64(p.Bytes-p.BytesDone) / float64(p.BytesDone))
+		times += ", about " + remaining.Round(time.Second).String() + " left"
+	}
+	ui.timeLabel.SetText(times)
+}
+
+// cancelJob stops the running job, its unfinished files are removed. With nothing running it closes
+// the window.
+func (ui *goCryptorUI) cancelJob() {
+	ui.jobMu.Lock()
+	j := ui.job
+	ui.jobMu.Unlock()
+	if j == nil {
+		ui.window.Close()
+		return
+	}
+	ui.currentLabel.SetText("Cancelling...")
+	j.cancel()
+}
+
+// stopJob cancels any running job and waits for it to remove its unfinished files, so closing the
+// window leaves nothing half written behind
+func (ui *goCryptorUI) stopJob() {
+	ui.jobMu.Lock()
+	j := ui.job
+	ui.jobMu.Unlock()
+	if j != nil {
+		j.cancel()
+		<-j.done
+	}
+}
+
+// showListing shows a scrollable report of files in a dialog
+func (ui *goCryptorUI) showListing(title, listing string) {
+	scroll := widget.NewScrollContainer(widget.NewLabel(listing))
+	scroll.SetMinSize(fyne.NewSize(420, 240))
+	fynedialog.ShowCustom(title, "Close", scroll, ui.window)
+}
+
+// statuses of a file in the queue
+const (
+	queuePending = "pending"
+	queueDone    = "done"
+	queueSkipped = "skipped"
+	queueFailed  = "failed"
+)
 
-	ui.statusLabel.SetText("Success decrypting file!")
-	go ui.statusFade(8)
-	ui.passwordEntry.SetText("")
-	ui.passConfirmEntry.SetText("")
-	ui.fileName = ""
-	ui.fileNameLabel.SetText("File Path: ")
+// queueEntry is a file of the queue, reason says why it was skipped or failed, or what was done with
+// the input afterwards
+type queueEntry struct {
+	path   string
+	status string
+	reason string
+	label  *widget.Label
+}
+
+// batchQueue lists every file of the last encrypt or decrypt with its status, so all the failures of
+// a folder can be read, retried and exported rather than only the last one
+type batchQueue struct {
+	mu      sync.Mutex
+	action  string
+	root    string
+	isDir   bool
+	entries []*queueEntry
+	byPath  map[string]*queueEntry
+	title   *widget.Label
+	box     *widget.Box
+}
+
+func newBatchQueue() *batchQueue {
+	return &batchQueue{
+		byPath: make(map[string]*queueEntry),
+		title:  widget.NewLabel("Queue: empty"),
+		box:    widget.NewVBox(),
+	}
+}
+
+// start lists the files of a new run as pending. A retry keeps the rest of the list and only puts
+// its files back to pending.
+func (q *batchQueue) start(action, root string, isDir bool, paths []string, retry bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if retry && action == q.action && root == q.root {
+		for _, path := range paths {
+			if entry, ok := q.byPath[path]; ok {
+				q.set(entry, queuePending, "")
+			}
+		}
+		return
+	}
+	q.action, q.root, q.isDir = action, root, isDir
+	q.entries = make([]*queueEntry, len(paths))
+	q.byPath = make(map[string]*queueEntry, len(paths))
+	rows := make([]fyne.CanvasObject, len(paths))
+	for i, path := range paths {
+		entry := &queueEntry{path: path, status: queuePending, label: widget.NewLabel("")}
+		entry.label.SetText(q.text(entry))
+		q.entries[i], q.byPath[path], rows[i] = entry, entry, entry.label
+	}
+	q.box.Children = rows
+	q.box.Refresh()
+	q.title.SetText(fmt.Sprintf("Queue: %s %s, %d file(s)", action, filepath.Base(root), len(paths)))
+}
+
+// record sets the status of a file from its result
+func (q *batchQueue) record(res fileResult) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	entry, ok := q.byPath[res.Path]
+	if !ok {
+		return
+	}
+	switch {
+	case res.Skipped != "":
+		q.set(entry, queueSkipped, res.Skipped)
+	case res.Error != "":
+		q.set(entry, queueFailed, res.Error)
+	case res.Warning != "":
+		q.set(entry, queueDone, res.Warning)
+	case res.Disposed != "":
+		q.set(entry, queueDone, res.Disposed+" input")
+	default:
+		q.set(entry, queueDone, "")
+	}
+}
+
+func (q *batchQueue) set(entry *queueEntry, status, reason string) {
+	entry.status, entry.reason = status, reason
+	entry.label.SetText(q.text(entry))
+}
+
+// text is how an entry is shown, with the path relative to the folder that was processed
+func (q *batchQueue) text(entry *queueEntry) string {
+	name := filepath.Base(entry.path)
+	if q.isDir {
+		if rel, err := filepath.Rel(q.root, entry.path); err == nil {
+			name = rel
+		}
+	}
+	if entry.reason == "" {
+		return entry.status + "  " + name
+	}
+	return entry.status + "  " + name + ": " + entry.reason
+}
+
+// unfinished returns the run the queue holds and its files that failed, or are still pending
+// because it was cancelled
+func (q *batchQueue) unfinished() (action, root string, isDir bool, paths []string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, entry := range q.entries {
+		if entry.status == queueFailed || entry.status == queuePending {
+			paths = append(paths, entry.path)
+		}
+	}
+	return q.action, q.root, q.isDir, paths
+}
+
+// export writes one tab separated line per file: status, path and reason
+func (q *batchQueue) export(fileName string) error {
+	q.mu.Lock()
+	var list bytes.Buffer
+	for _, entry := range q.entries {
+		fmt.Fprintf(&list, "%s\t%s\t%s\n", entry.status, entry.path, entry.reason)
+	}
+	q.mu.Unlock()
+	return ioutil.WriteFile(fileName, list.Bytes(), 0644)
+}
+
+// batchOptions describes the action with the GUI settings the same way the command line would
+func (ui *goCryptorUI) batchOptions(action string) *options {
+	dispose := ui.afterEncrypt
+	if action == "decrypt" {
+		dispose = ui.afterDecrypt
+	}
+	return &options{
+		command:  action,
+		fileName: ui.fileName,
+		conflict: ui.conflict,
+		ask:      ui.askConflict,
+		includes: splitPatterns(ui.includeEntry.Text),
+		excludes: splitPatterns(ui.excludeEntry.Text),
+		dispose:  dispose,
+	}
+}
+
+// askConflict asks whether to replace an existing output file, answering no skips the file. Files of
+// a folder are processed at once so the questions are asked one at a time.
+func (ui *goCryptorUI) askConflict(path string) encryptor.ConflictPolicy {
+	ui.askMu.Lock()
+	defer ui.askMu.Unlock()
+	replace := dialog.Message("%s already exists.\n\nReplace it? Choosing No skips this file.", path).Title("File exists").YesNo()
+	if replace {
+		return encryptor.ConflictOverwrite
+	}
+	return encryptor.ConflictSkip
 }
 
 func (ui *goCryptorUI) validateInformation() error {
@@ -189,32 +652,6 @@ func (ui *goCryptorUI) browseFolder() string {
 	return folderName
 }
 
-func parseFlags(logger *log.Logger) (string, string) {
-	flaggy.SetName("goCryptor")
-	flaggy.SetDescription("Encrypts and decrypts files and folders")
-	flaggy.DefaultParser.ShowHelpOnUnexpected = true
-	// set the default of encrypt
-	var encryptFlag string
-	// setup the encrypt flag
-	flaggy.String(&encryptFlag, "e", "encrypt", "encrypt a file or folder")
-	// decrypt var
-	var decryptFlag string
-	flaggy.String(&decryptFlag, "d", "decrypt", "selects file to decrypt")
-	// parse the results
-	flaggy.Parse()
-	if encryptFlag != "" && decryptFlag != "" {
-		fmt.Println("cannot perform both encrypt and decrypt in one run")
-		os.Exit(0)
-	}
-	if encryptFlag != "" {
-		return "encrypt", encryptFlag
-	}
-	if decryptFlag != "" {
-		return "decrypt", decryptFlag
-	}
-	return "", ""
-}
-
 // validateFileName checks a few things about the supplied name to make sure it is legit
 func validateFileName(fileName string) (bool, error) {
 	// if no filename at all supplied then just return to the main so the user can chose one
@@ -246,13 +683,20 @@ func main() {
 	ui := goCryptorUI{}
 	// add our logger
 	ui.logger = logger
+	// the agent (if one is running) supplies cached passwords and derived keys
+	ui.agentClient = agent.NewClient()
 	// action attempts to automatically determine if we are encrypting or decrypting
 	ui.action = "encrypt"
+	opts := parseFlags(logger)
+	// subcommands run headless and never open a window
+	if opts.command != "" {
+		os.Exit(runCommand(logger, opts))
+	}
+	actionText, keyProvider := opts.action, opts.keyProvider
 	// fileName is the name of the file or folder to encrypt
-	actionText, fileName := parseFlags(logger)
-	ui.fileName = fileName
-	if fileName != "" {
-		_, err := validateFileName(fileName)
+	ui.fileName = opts.fileName
+	if ui.fileName != "" {
+		_, err := validateFileName(ui.fileName)
 		if err != nil {
 			logger.Println("error reading file: ", err)
 			os.Exit(0)
@@ -261,22 +705,31 @@ func main() {
 	mainApp := app.New()
 	mainApp.SetIcon(resources.GoCryptorIcon)
 	mainWindow := mainApp.NewWindow("goCryptor")
+	ui.window = mainWindow
 	mainWindow.SetFixedSize(true)
 	mainWindow.CenterOnScreen()
 	// Setup the text at the top of the app
 	mainTitle := widget.NewLabelWithStyle("goCryptor", fyne.TextAlignCenter, fyne.TextStyle{Bold: true})
 	// Setup file selection area
 	ui.fileNameLabel = widget.NewLabel("File Path: " + filepath.Base(ui.fileName))
-	// create the overwrite check box, and set it to true by default
-	overwriteCheck := widget.NewCheck("Overwrite on Decrypt", func(bool) {
-		if ui.overwriteFile == true {
-			ui.overwriteFile = false
-		} else {
-			ui.overwriteFile = true
-		}
+	// what to do when an output file exists, overwrite by default
+	conflictSelect := widget.NewSelect([]string{"overwrite", "skip", "number", "fail", "ask"}, func(choice string) {
+		ui.conflict, _ = encryptor.ParseConflictPolicy(choice)
+	})
+	conflictSelect.SetSelected(encryptor.ConflictOverwrite.String())
+	// what to do with the original once it is encrypted and verified, or with the .gcx once decrypted
+	dispositions := []string{"keep", "trash", "delete", "shred"}
+	afterEncryptSelect := widget.NewSelect(dispositions, func(choice string) {
+		ui.afterEncrypt, _ = encryptor.ParseDisposition(choice)
+	})
+	afterEncryptSelect.SetSelected(encryptor.DispositionKeep.String())
+	afterDecryptSelect := widget.NewSelect(dispositions, func(choice string) {
+		ui.afterDecrypt, _ = encryptor.ParseDisposition(choice)
+	})
+	afterDecryptSelect.SetSelected(encryptor.DispositionKeep.String())
+	dryRunCheck := widget.NewCheck("Dry run", func(checked bool) {
+		ui.dryRun = checked
 	})
-	overwriteCheck.SetChecked(true)
-	ui.overwriteFile = true
 	// File selection box
 	selectBox := widget.NewHBox(
 		widget.NewButton("Select File", func() {
@@ -287,7 +740,7 @@ func main() {
 			ui.fileName = ui.browseFolder()
 			ui.fileNameLabel.SetText("File Path: " + filepath.Base(ui.fileName))
 		}),
-		overwriteCheck,
+		dryRunCheck,
 	)
 
 	// Setting up the form for the password entry
@@ -298,6 +751,40 @@ func main() {
 	// Use the append function to add in both of the inputs with labels
 	passwordForm.Append("Password: ", ui.passwordEntry)
 	passwordForm.Append("Confirm Password: ", ui.passConfirmEntry)
+	// patterns for folders, a .gcxignore in the folder is used as well
+	ui.includeEntry = widget.NewEntry()
+	ui.includeEntry.SetPlaceHolder("all files, or e.g. *.docx, reports/")
+	ui.includeEntry.SetText(strings.Join(opts.includes, ", "))
+	ui.excludeEntry = widget.NewEntry()
+	ui.excludeEntry.SetPlaceHolder("e.g. .git/, node_modules/")
+	ui.excludeEntry.SetText(strings.Join(opts.excludes, ", "))
+	passwordForm.Append("Include: ", ui.includeEntry)
+	passwordForm.Append("Exclude: ", ui.excludeEntry)
+	passwordForm.Append("If file exists: ", conflictSelect)
+	passwordForm.Append("Original after encrypt: ", afterEncryptSelect)
+	passwordForm.Append(".gcx after decrypt: ", afterDecryptSelect)
+	ui.rememberPassword = opts.rememberPassword
+	rememberCheck := widget.NewCheck("Remember password in agent", func(checked bool) {
+		ui.rememberPassword = checked
+	})
+	rememberCheck.SetChecked(ui.rememberPassword)
+	passwordForm.Append("Agent: ", rememberCheck)
+	// If a password source was given on the command line fill in both entries from it. A password
+	// remembered by a running agent only fills the first, it is still confirmed by typing it again.
+	if keyProvider == nil {
+		if password, ok := ui.agentClient.Get(agent.PasswordName); ok {
+			ui.passwordEntry.SetText(string(password))
+		}
+	} else {
+		password, err := keyProvider.Password(false)
+		if err != nil {
+			logger.Println("error reading password: ", err)
+			fmt.Println("error reading password: ", err)
+			os.Exit(1)
+		}
+		ui.passwordEntry.SetText(password)
+		ui.passConfirmEntry.SetText(password)
+	}
 	// Setup the status message
 	ui.statusLabel = widget.NewLabelWithStyle("", fyne.TextAlignCenter, fyne.TextStyle{Bold: true})
 	// Setup scroll container for status message
@@ -314,13 +801,36 @@ func main() {
 		ui.decryptFile()
 	})
 	decryptButton.Style = widget.PrimaryButton
+	// Setup Verify Button, it checks files against the password without writing anything
+	verifyButton := widget.NewButton("Verify", func() {
+		ui.verifyFiles()
+	})
+	// Setup the progress of a running job
+	ui.progressBar = widget.NewProgressBar()
+	ui.currentLabel = widget.NewLabel("")
+	ui.timeLabel = widget.NewLabel("")
+	// Setup the queue of the last encrypt or decrypt, failed files can be retried and the list saved
+	ui.queue = newBatchQueue()
+	queueScroll := widget.NewScrollContainer(ui.queue.box)
+	queueScroll.SetMinSize(fyne.NewSize(420, 160))
+	retryButton := widget.NewButton("Retry Failed", func() {
+		ui.retryFailed()
+	})
+	exportButton := widget.NewButton("Export", func() {
+		ui.exportQueue()
+	})
 	// Using actionText to see if we are only performing a certain action (from command line)
 	switch actionText {
 	case "encrypt":
 		decryptButton.Disable()
+		ui.actionButtons = []*widget.Button{encryptButton, verifyButton}
 	case "decrypt":
 		encryptButton.Disable()
+		ui.actionButtons = []*widget.Button{decryptButton, verifyButton}
+	default:
+		ui.actionButtons = []*widget.Button{encryptButton, decryptButton, verifyButton}
 	}
+	ui.actionButtons = append(ui.actionButtons, retryButton)
 	// Create our URL
 	url, err := url.Parse("https://github.com")
 	if err != nil {
@@ -328,11 +838,13 @@ func main() {
 	}
 	// Put both of the Buttons in an Hbox with a spacer in between
 	buttons := widget.NewHBox(
+		// Cancel stops a running job, otherwise it closes the window
 		widget.NewButton("Cancel", func() {
-			mainWindow.Close()
+			ui.cancelJob()
 		}),
 		widget.NewHyperlink("About ", url),
 		layout.NewSpacer(),
+		verifyButton,
 		decryptButton,
 		encryptButton,
 	)
@@ -345,6 +857,10 @@ func main() {
 		layout.NewSpacer(),
 		passwordForm,
 		scrollContainer,
+		ui.progressBar,
+		widget.NewHBox(ui.currentLabel, layout.NewSpacer(), ui.timeLabel),
+		widget.NewHBox(ui.queue.title, layout.NewSpacer(), retryButton, exportButton),
+		queueScroll,
 		layout.NewSpacer(),
 		buttons,
 	)
@@ -359,10 +875,11 @@ func main() {
 	}
 	// Set our main layout and input our Vertical Box into it
 	// Give the box a fixed size so it isn't too squished
-	boxSize := fyne.NewSize(450, 300)
+	boxSize := fyne.NewSize(450, 800)
 	mainLayout := layout.NewGridWrapLayout(boxSize)
 	// Put our layout into a container to display it
 	mainContainer := fyne.NewContainerWithLayout(mainLayout, fullBox)
 	mainWindow.SetContent(mainContainer)
+	mainWindow.SetOnClosed(ui.stopJob)
 	mainWindow.ShowAndRun()
 }
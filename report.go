@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// fileResult is the outcome of processing one file, printed as a line of --json output
+type fileResult struct {
+	Path   string `json:"path"`
+	Action string `json:"action"`
+	Output string `json:"output,omitempty"`
+	// Bytes is the size of the input file
+	Bytes      int64  `json:"bytes"`
+	DurationMS int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+	// Code is the exit code this file alone would produce
+	Code int `json:"code"`
+	// DryRun marks results that only describe what would happen
+	DryRun bool `json:"dry_run,omitempty"`
+	// Skipped gives the reason a file was left out
+	Skipped string `json:"skipped,omitempty"`
+	// Conflict means the output already exists and would be replaced
+	Conflict bool `json:"conflict,omitempty"`
+	// Status is skipped for a file left out, otherwise the verdict of a verify: intact, corrupt,
+	// wrong key or error
+	Status string `json:"status,omitempty"`
+	// Disposed is what was done, or would be done, with the input afterwards: trash, delete or shred
+	Disposed string `json:"disposed,omitempty"`
+	// Warning says what went wrong after the output was written, the input could not be disposed of
+	Warning string `json:"warning,omitempty"`
+}
+
+// summary closes --json output for a run
+type summary struct {
+	Summary    bool   `json:"summary"`
+	Action     string `json:"action"`
+	Files      int    `json:"files"`
+	Succeeded  int    `json:"succeeded"`
+	Failed     int    `json:"failed"`
+	Skipped    int    `json:"skipped,omitempty"`
+	Warnings   int    `json:"warnings,omitempty"`
+	Bytes      int64  `json:"bytes"`
+	DurationMS int64  `json:"duration_ms"`
+	Code       int    `json:"code"`
+	DryRun     bool   `json:"dry_run,omitempty"`
+	// Intact, Corrupt and WrongKey break down the files checked by verify
+	Intact   int `json:"intact,omitempty"`
+	Corrupt  int `json:"corrupt,omitempty"`
+	WrongKey int `json:"wrong_key,omitempty"`
+}
+
+// reporter prints file results as text lines or, with --json, one JSON object per file and a summary
+type reporter struct {
+	json bool
+	out  io.Writer
+	// errOut receives failures in text mode
+	errOut  io.Writer
+	start   time.Time
+	summary summary
+}
+
+func newReporter(jsonOutput bool, out io.Writer, action string) *reporter {
+	return &reporter{json: jsonOutput, out: out, errOut: os.Stderr, start: time.Now(), summary: summary{Summary: true, Action: action}}
+}
+
+// file reports one processed, planned or skipped file
+func (r *reporter) file(res fileResult) {
+	r.summary.DryRun = r.summary.DryRun || res.DryRun
+	if res.Skipped != "" {
+		res.Status = "skipped"
+	} else if res.Action == "verify" && !res.DryRun {
+		res.Status = verifyStatus(res.Code)
+		switch res.Code {
+		case exitOK:
+			r.summary.Intact++
+		case exitCorrupt:
+			r.summary.Corrupt++
+		case exitWrongKey:
+			r.summary.WrongKey++
+		}
+	}
+	switch {
+	case res.Skipped != "":
+		r.summary.Skipped++
+	case res.Error != "":
+		r.summary.Files++
+		r.summary.Failed++
+	default:
+		r.summary.Files++
+		r.summary.Succeeded++
+	}
+	if res.Warning != "" {
+		r.summary.Warnings++
+	}
+	r.summary.Bytes += res.Bytes
+	if r.json {
+		json.NewEncoder(r.out).Encode(res)
+		return
+	}
+	switch {
+	case res.Skipped != "":
+		fmt.Fprintf(r.out, "skip: %s (%s)\n", res.Path, res.Skipped)
+	case res.Error != "" && res.Status != "":
+		fmt.Fprintf(r.errOut, "%s: %s: %s\n", res.Status, res.Path, res.Error)
+	case res.Error != "":
+		fmt.Fprintf(r.errOut, "%s failed: %s: %s\n", res.Action, res.Path, res.Error)
+	case res.DryRun && res.Output == "":
+		fmt.Fprintf(r.out, "would %s: %s\n", res.Action, res.Path)
+	case res.DryRun && res.Conflict:
+		fmt.Fprintf(r.out, "would %s: %s -> %s (replaces existing file)%s\n", res.Action, res.Path, res.Output, disposedNote(res))
+	case res.DryRun:
+		fmt.Fprintf(r.out, "would %s: %s -> %s%s\n", res.Action, res.Path, res.Output, disposedNote(res))
+	case res.Status != "":
+		fmt.Fprintf(r.out, "%s: %s\n", res.Status, res.Path)
+	case res.Warning != "":
+		fmt.Fprintf(r.out, "%s ok: %s -> %s\n", res.Action, res.Path, res.Output)
+		fmt.Fprintf(r.errOut, "warning: %s: %s\n", res.Path, res.Warning)
+	default:
+		fmt.Fprintf(r.out, "%s ok: %s%s\n", res.Action, res.Path, disposedNote(res))
+	}
+}
+
+// disposedNote describes what happened to the input after it was processed, if anything
+func disposedNote(res fileResult) string {
+	if res.Disposed == "" {
+		return ""
+	}
+	return ", then " + res.Disposed + " input"
+}
+
+// walkError reports a folder that could not be walked
+func (r *reporter) walkError(err error) {
+	fmt.Fprintln(r.errOut, "Error:", err)
+}
+
+// finish prints the summary in JSON mode, text output only gets a tally after verifying
+func (r *reporter) finish(code int) {
+	if !r.json {
+		if r.summary.Action == "verify" && !r.summary.DryRun && r.summary.Files > 1 {
+			fmt.Fprintf(r.out, "%d intact, %d corrupt, %d wrong key, %d other errors\n", r.summary.Intact,
+				r.summary.Corrupt, r.summary.WrongKey, r.summary.Failed-r.summary.Corrupt-r.summary.WrongKey)
+		}
+		return
+	}
+	r.summary.DurationMS = time.Since(r.start).Milliseconds()
+	r.summary.Code = code
+	json.NewEncoder(r.out).Encode(r.summary)
+}
+
+// verifyStatus names the outcome of verifying a file from its exit code
+func verifyStatus(code int) string {
+	switch code {
+	case exitOK:
+		return "intact"
+	case exitCorrupt:
+		return "corrupt"
+	case exitWrongKey:
+		return "wrong key"
+	}
+	return "error"
+}
+
+// progressPrinter returns a progress callback that writes a line to w at most once a second, and
+// always once the last file is done
+func progressPrinter(w io.Writer) func(batchProgress) {
+	var last time.Time
+	return func(p batchProgress) {
+		if p.FilesDone < p.Files && time.Since(last) < time.Second {
+			return
+		}
+		last = time.Now()
+		percent := int64(100)
+		if p.Bytes > 0 {
+			percent = 100 * p.BytesDone / p.Bytes
+		}
+		fmt.Fprintf(w, "progress: %d/%d files, %s of %s (%d%%)\n", p.FilesDone, p.Files, formatBytes(p.BytesDone), formatBytes(p.Bytes), percent)
+	}
+}
+
+// formatBytes gives a size in the largest binary unit that keeps it at 1 or more
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	value, prefix := float64(n)/unit, 0
+	for value >= unit && prefix < 4 {
+		value /= unit
+		prefix++
+	}
+	return fmt.Sprintf("%.1f %ciB", value, "KMGTP"[prefix])
+}
+
+// fileSize returns the size of path, 0 if it cannot be read
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}